@@ -0,0 +1,324 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"sync"
+)
+
+// Batch is a group of events sent by the server as an IRCv3 batch (see
+// https://ircv3.net/specs/extensions/batch), like a netsplit, or the reply
+// to a CHATHISTORY request.
+type Batch struct {
+	// Ref is the reference tag the server used to identify the batch.
+	Ref string
+	// Type is the type of the batch, e.g. "netsplit" or "chathistory".
+	Type string
+	// Params are the additional parameters of the batch, which depend on
+	// the batch type.
+	Params []string
+	// Origin is the BATCH event which started the batch.
+	Origin *Event
+	// Events are the events within the batch, in the order they have been
+	// received. Events within nested batches are not included. At most
+	// 4096 events are collected, any further events are left out.
+	Events []*Event
+	// Batches are the batches nested within the batch, in the order they
+	// have been completed.
+	Batches []*Batch
+
+	// parent is the batch this batch is nested within, if any.
+	parent *Batch
+	// dispatch is false if the events within the batch shouldn't be passed
+	// to event handlers individually.
+	dispatch bool
+	// replay is true if the events within the batch are past messages
+	// replayed by the server (e.g. chathistory), which mustn't be passed to
+	// the internal handlers keeping track of the state.
+	replay bool
+}
+
+// Copy makes a deep copy of the batch, including all of its events and
+// nested batches.
+func (b *Batch) Copy() *Batch {
+	if b == nil {
+		return nil
+	}
+
+	newBatch := &Batch{
+		Ref:    b.Ref,
+		Type:   b.Type,
+		Origin: b.Origin.Copy(),
+	}
+
+	if b.Params != nil {
+		newBatch.Params = make([]string, len(b.Params))
+		copy(newBatch.Params, b.Params)
+	}
+
+	if b.Events != nil {
+		newBatch.Events = make([]*Event, len(b.Events))
+		for i := range b.Events {
+			newBatch.Events[i] = b.Events[i].Copy()
+		}
+	}
+
+	if b.Batches != nil {
+		newBatch.Batches = make([]*Batch, len(b.Batches))
+		for i := range b.Batches {
+			newBatch.Batches[i] = b.Batches[i].Copy()
+		}
+	}
+
+	return newBatch
+}
+
+// BatchHandler is a type that represents the function necessary to
+// implement a batch handler.
+type BatchHandler func(client *Client, batch Batch)
+
+// batchHandler is a registered BatchHandler.
+type batchHandler struct {
+	handler  BatchHandler
+	dispatch bool
+}
+
+// Batches handles the storage and execution of batch handlers against
+// incoming batches. The events within batches of a type without a handler
+// are passed to event handlers as usual, except for chathistory batches, and
+// draft/multiline batches, which are passed to event handlers as a single
+// message with the lines joined by newlines.
+type Batches struct {
+	// mu is the mutex that should be used when accessing any batch handlers.
+	mu sync.RWMutex
+	// handlers is a map of batch type -> handler.
+	handlers map[string]batchHandler
+}
+
+// newBatches returns a new clean batch handler.
+func newBatches() *Batches {
+	return &Batches{handlers: map[string]batchHandler{}}
+}
+
+// Set saves handler for execution once a batch of batchType has been
+// received completely. If dispatch is true, the events within the batch are
+// passed to event handlers as they are received as well. Otherwise, they are
+// only passed to internal handlers (which keep track of the state). This
+// also applies to batches nested within such a batch. The events within
+// chathistory batches are never passed to internal handlers, as past
+// messages mustn't affect the state.
+//
+// The handler of a nested batch is executed once it has been received
+// completely as well, regardless of the handler of the enclosing batch. Use
+// SetBg if the handler may take an extended period of time to execute.
+func (b *Batches) Set(batchType string, dispatch bool, handler func(client *Client, batch Batch)) {
+	if batchType == "" {
+		return
+	}
+
+	b.mu.Lock()
+	b.handlers[strings.ToLower(batchType)] = batchHandler{handler: BatchHandler(handler), dispatch: dispatch}
+	b.mu.Unlock()
+}
+
+// SetBg is much like Set, however the handler is executed in the background,
+// ensuring that event handling isn't hung during long running tasks. See Set
+// for more information.
+func (b *Batches) SetBg(batchType string, dispatch bool, handler func(client *Client, batch Batch)) {
+	b.Set(batchType, dispatch, func(client *Client, batch Batch) {
+		go handler(client, batch)
+	})
+}
+
+// Clear removes currently setup handler for batchType, if one is set.
+func (b *Batches) Clear(batchType string) {
+	b.mu.Lock()
+	delete(b.handlers, strings.ToLower(batchType))
+	b.mu.Unlock()
+}
+
+// ClearAll removes all currently setup batch handlers.
+func (b *Batches) ClearAll() {
+	b.mu.Lock()
+	b.handlers = map[string]batchHandler{}
+	b.mu.Unlock()
+}
+
+// get returns the handler for batchType, if any.
+func (b *Batches) get(batchType string) (handler batchHandler, ok bool) {
+	b.mu.RLock()
+	handler, ok = b.handlers[strings.ToLower(batchType)]
+	b.mu.RUnlock()
+
+	return handler, ok
+}
+
+// call executes the handler for a completed batch, if any.
+func (b *Batches) call(client *Client, batch *Batch) {
+	handler, ok := b.get(batch.Type)
+	if !ok {
+		return
+	}
+
+	// If they want to catch any panics, add to defer stack.
+	if client.Config.RecoverFunc != nil && batch.Origin != nil {
+		defer recoverHandlerPanic(client, batch.Origin, "batch-"+strings.ToLower(batch.Type), 3)
+	}
+
+	handler.handler(client, *batch.Copy())
+}
+
+// batchRef returns the reference tag of the batch event belongs to, if any.
+func batchRef(event *Event) (ref string, ok bool) {
+	ref, ok = event.Tags.Get("batch")
+	return ref, ok && ref != ""
+}
+
+// handleBatch keeps track of the batches opened and closed by the server,
+// and collects the events within them. dispatch is true if the event should
+// be passed to event handlers individually, and false if it should only be
+// passed to internal handlers. track is false if it shouldn't be passed to
+// internal handlers either, as it's a replayed past message.
+func (c *Client) handleBatch(event *Event) (dispatch, track bool) {
+	if event.Command == BATCH && len(event.Params) > 0 && len(event.Params[0]) > 1 {
+		ref := event.Params[0][1:]
+
+		switch event.Params[0][0] {
+		case '+':
+			if len(event.Params) < 2 {
+				break
+			}
+
+			batch := &Batch{
+				Ref:      ref,
+				Type:     event.Params[1],
+				Params:   event.Params[2:],
+				Origin:   event.Copy(),
+				dispatch: true,
+			}
+
+			c.state.Lock()
+			if parentRef, ok := batchRef(event); ok {
+				batch.parent = c.state.batches[parentRef]
+			}
+
+			if batch.parent != nil {
+				batch.dispatch = batch.parent.dispatch
+				batch.replay = batch.parent.replay
+			}
+
+			if strings.EqualFold(batch.Type, "chathistory") {
+				batch.replay = true
+			}
+
+			if handler, ok := c.Batches.get(batch.Type); ok {
+				if !handler.dispatch {
+					batch.dispatch = false
+				}
+			} else if strings.EqualFold(batch.Type, "chathistory") {
+				// The events within chathistory batches are past messages,
+				// which have been requested explicitly (see
+				// Client.History()).
+				batch.dispatch = false
+			} else if strings.EqualFold(batch.Type, multilineBatch) {
+				// The lines of multiline messages are passed to event
+				// handlers as a single message once complete (see
+				// Client.receiveMultiline()).
+				batch.dispatch = false
+			}
+
+			c.state.openBatch(batch)
+			c.state.Unlock()
+
+			return batch.parent == nil || batch.parent.dispatch, true
+		case '-':
+			c.state.Lock()
+			batch, ok := c.state.closeBatch(ref)
+			if ok {
+				if batch.parent != nil {
+					batch.parent.Batches = append(batch.parent.Batches, batch)
+				}
+			}
+			c.state.Unlock()
+
+			if !ok {
+				return true, true
+			}
+
+			c.requests.receiveBatch(batch)
+			c.Batches.call(c, batch)
+
+			dispatch = batch.parent == nil || batch.parent.dispatch
+			if strings.EqualFold(batch.Type, multilineBatch) {
+				c.receiveMultiline(batch, dispatch)
+			}
+
+			return dispatch, true
+		}
+	}
+
+	ref, ok := batchRef(event)
+	if !ok {
+		return true, true
+	}
+
+	c.state.Lock()
+	defer c.state.Unlock()
+
+	batch, ok := c.state.batches[ref]
+	if !ok {
+		return true, true
+	}
+
+	if len(batch.Events) < maxBatchEvents {
+		batch.Events = append(batch.Events, event.Copy())
+	}
+
+	return batch.dispatch, !batch.replay
+}
+
+const (
+	// maxOpenBatches is the maximum number of batches kept open, before the
+	// oldest one is dropped, in case the server never closes them.
+	maxOpenBatches = 128
+	// maxBatchEvents is the maximum number of events collected per batch.
+	maxBatchEvents = 4096
+)
+
+// openBatch keeps track of batch until it's closed, dropping the oldest open
+// batch if there are too many of them. s must be locked.
+func (s *state) openBatch(batch *Batch) {
+	if _, ok := s.batches[batch.Ref]; ok {
+		s.closeBatch(batch.Ref)
+	}
+
+	if len(s.batchOrder) >= maxOpenBatches {
+		delete(s.batches, s.batchOrder[0])
+		s.batchOrder = s.batchOrder[1:]
+	}
+
+	s.batches[batch.Ref] = batch
+	s.batchOrder = append(s.batchOrder, batch.Ref)
+}
+
+// closeBatch stops keeping track of the batch with the given reference tag,
+// and returns it, if it's open. s must be locked.
+func (s *state) closeBatch(ref string) (batch *Batch, ok bool) {
+	batch, ok = s.batches[ref]
+	if !ok {
+		return nil, false
+	}
+
+	delete(s.batches, ref)
+	for i := range s.batchOrder {
+		if s.batchOrder[i] == ref {
+			s.batchOrder = append(s.batchOrder[:i], s.batchOrder[i+1:]...)
+			break
+		}
+	}
+
+	return batch, true
+}
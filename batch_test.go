@@ -0,0 +1,167 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const mockBatch = ":dummy.int BATCH +outer example.com/foo bar\r\n" +
+	"@batch=outer :dummy.int BATCH +split netsplit hub.int leaf.int\r\n" +
+	"@batch=split :nick1!user@host QUIT :hub.int leaf.int\r\n" +
+	"@batch=split :nick2!user@host QUIT :hub.int leaf.int\r\n" +
+	"@batch=outer :nick3!user@host PRIVMSG #channel :inside\r\n" +
+	":dummy.int BATCH -split\r\n" +
+	":dummy.int BATCH -outer\r\n" +
+	":nick3!user@host PRIVMSG #channel :outside\r\n"
+
+func TestBatch(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer c.Close()
+	defer server.Close()
+	go mockReadBuffer(server)
+
+	batches := make(chan Batch, 2)
+	c.Batches.Set("netsplit", false, func(c *Client, b Batch) { batches <- b })
+	c.Batches.Set("EXAMPLE.COM/FOO", true, func(c *Client, b Batch) { batches <- b })
+
+	events := make(chan string, 10)
+	c.Handlers.Add(QUIT, func(c *Client, e Event) { events <- e.String() })
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { events <- e.Last() })
+
+	go c.MockConnect(conn)
+
+	if _, err := server.Write([]byte(mockBatch)); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() Batch {
+		t.Helper()
+
+		select {
+		case b := <-batches:
+			return b
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for batch")
+		}
+
+		return Batch{}
+	}
+
+	split := next()
+	if split.Ref != "split" || split.Type != "netsplit" || !reflect.DeepEqual(split.Params, []string{"hub.int", "leaf.int"}) {
+		t.Fatalf("netsplit batch == %#v", split)
+	}
+
+	if len(split.Events) != 2 || split.Events[0].Source.Name != "nick1" || split.Events[1].Source.Name != "nick2" {
+		t.Fatalf("netsplit batch has wrong events: %v", split.Events)
+	}
+
+	outer := next()
+	if outer.Type != "example.com/foo" || len(outer.Events) != 1 || outer.Events[0].Last() != "inside" {
+		t.Fatalf("outer batch == %#v", outer)
+	}
+
+	if len(outer.Batches) != 1 || outer.Batches[0].Ref != "split" || len(outer.Batches[0].Events) != 2 {
+		t.Fatalf("outer batch has wrong nested batches: %#v", outer.Batches)
+	}
+
+	// The QUITs shouldn't be dispatched individually, while the PRIVMSG
+	// within the outer batch should.
+	for _, want := range []string{"inside", "outside"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("handler received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestBatchReplay(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer c.Close()
+	defer server.Close()
+	go mockReadBuffer(server)
+
+	history := make(chan Batch, 1)
+	c.Batches.Set("chathistory", true, func(c *Client, b Batch) { history <- b })
+
+	notices := make(chan struct{}, 2)
+	c.Handlers.Add(NOTICE, func(c *Client, e Event) { notices <- struct{}{} })
+
+	go c.MockConnect(conn)
+
+	write := func(raw string) {
+		t.Helper()
+
+		if _, err := server.Write([]byte(raw + ":dummy.int NOTICE test :done\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-notices:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for NOTICE")
+		}
+	}
+
+	write(":test!user@host JOIN #channel\r\n:nick!user@host JOIN #channel\r\n")
+
+	user := c.LookupUser("nick")
+	if user == nil {
+		t.Fatal("nick isn't tracked")
+	}
+
+	write(":dummy.int BATCH +h chathistory #channel\r\n" +
+		"@batch=h;account=old :nick!user@host PRIVMSG #channel :replayed\r\n" +
+		":dummy.int BATCH -h\r\n")
+
+	if b := <-history; len(b.Events) != 1 {
+		t.Fatalf("chathistory batch has wrong events: %v", b.Events)
+	}
+
+	// The replayed message is dispatched, as requested by the batch handler,
+	// but mustn't affect the state.
+	replayed := c.LookupUser("nick")
+	if replayed.Extras.Account != "" || !replayed.LastActive.Equal(user.LastActive) {
+		t.Fatalf("replayed message updated the state: account %q, last active %s", replayed.Extras.Account, replayed.LastActive)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	for i := 0; i <= maxOpenBatches; i++ {
+		c.handleBatch(ParseEvent(fmt.Sprintf(":dummy.int BATCH +%d netsplit hub.int leaf.int", i)))
+	}
+
+	// The oldest batch, which was never closed, should have been dropped.
+	if len(c.state.batches) != maxOpenBatches || len(c.state.batchOrder) != maxOpenBatches {
+		t.Fatalf("%d open batches, want %d", len(c.state.batches), maxOpenBatches)
+	}
+
+	if _, ok := c.state.batches["0"]; ok {
+		t.Fatal("oldest batch wasn't dropped")
+	}
+
+	c.handleBatch(ParseEvent(":dummy.int BATCH -1"))
+	if _, ok := c.state.batches["1"]; ok || len(c.state.batchOrder) != maxOpenBatches-1 {
+		t.Fatal("closed batch is still open")
+	}
+
+	for i := 0; i < maxBatchEvents+10; i++ {
+		c.handleBatch(ParseEvent("@batch=2 :nick!user@host QUIT :hub.int leaf.int"))
+	}
+
+	if n := len(c.state.batches["2"].Events); n != maxBatchEvents {
+		t.Fatalf("batch collected %d events, want %d", n, maxBatchEvents)
+	}
+}
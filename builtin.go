@@ -5,6 +5,7 @@
 package girc
 
 import (
+	"sort"
 	"strings"
 	"time"
 )
@@ -16,10 +17,16 @@ func (c *Client) registerBuiltins() {
 	c.Handlers.mu.Lock()
 
 	// Built-in things that should always be supported.
+	c.Handlers.register(true, false, RPL_WELCOME, HandlerFunc(handleWelcome))
 	c.Handlers.register(true, true, RPL_WELCOME, HandlerFunc(handleConnect))
 	c.Handlers.register(true, false, PING, HandlerFunc(handlePING))
 	c.Handlers.register(true, false, PONG, HandlerFunc(handlePONG))
 
+	// Registration failures.
+	c.Handlers.register(true, false, ERR_PASSWDMISMATCH, HandlerFunc(handleRegisterError))
+	c.Handlers.register(true, false, ERR_YOUREBANNEDCREEP, HandlerFunc(handleRegisterError))
+	c.Handlers.register(true, false, ERR_ERRONEUSNICKNAME, HandlerFunc(handleRegisterError))
+
 	if !c.Config.disableTracking {
 		// Joins/parts/anything that may add/remove/rename users.
 		c.Handlers.register(true, false, JOIN, HandlerFunc(handleJOIN))
@@ -76,11 +83,10 @@ func (c *Client) registerBuiltins() {
 	c.Handlers.mu.Unlock()
 }
 
-// handleConnect is a helper function which lets the client know that enough
-// time has passed and now they can send commands.
-//
-// Should always run in separate thread due to blocking delay.
-func handleConnect(c *Client, e Event) {
+// handleWelcome tracks the nickname the server has registered us with. This
+// runs in the foreground, so the nickname is known before any other events
+// are processed.
+func handleWelcome(c *Client, e Event) {
 	// This should be the nick that the server gives us. 99% of the time, it's
 	// the one we supplied during connection, but some networks will rename
 	// users on connect.
@@ -92,12 +98,73 @@ func handleConnect(c *Client, e Event) {
 		c.state.notify(c, UPDATE_GENERAL)
 	}
 
+	c.mu.RLock()
+	if c.conn != nil {
+		c.conn.markRegistered()
+	}
+	c.mu.RUnlock()
+}
+
+// handleConnect is a helper function which lets the client know that enough
+// time has passed and now they can send commands.
+//
+// Should always run in separate thread due to blocking delay.
+func handleConnect(c *Client, e Event) {
 	time.Sleep(2 * time.Second)
 
-	c.mu.RLock()
+	if c.Config.RejoinChannels {
+		restoreState(c)
+	}
+
+	c.mu.Lock()
 	server := c.server()
-	c.mu.RUnlock()
+	reconnected := c.reconnects > 0
+	c.reconnects = 0
+	c.mu.Unlock()
 	c.RunHandlers(&Event{Command: CONNECTED, Params: []string{server}})
+
+	if reconnected {
+		c.RunHandlers(&Event{Command: RECONNECTED, Params: []string{server}})
+	}
+}
+
+// restoreState rejoins the channels we were in before the last reconnect,
+// and restores our away status.
+func restoreState(c *Client) {
+	c.state.Lock()
+	channels := c.state.rejoin
+	c.state.rejoin = nil
+	away := c.state.away
+	c.state.Unlock()
+
+	if len(channels) > 0 && c.Config.HandleRejoin != nil {
+		channels = c.Config.HandleRejoin(channels)
+	}
+
+	// Sort for a predictable join order.
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var keyless []string
+	for _, name := range names {
+		if channels[name] == "" {
+			keyless = append(keyless, name)
+			continue
+		}
+
+		c.Cmd.JoinKey(name, channels[name])
+	}
+
+	if len(keyless) > 0 {
+		c.Cmd.Join(keyless...)
+	}
+
+	if away != "" {
+		c.Cmd.Away(away)
+	}
 }
 
 // nickCollisionHandler helps prevent the client from having conflicting
@@ -5,7 +5,9 @@
 package girc
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +24,7 @@ var possibleCap = map[string][]string{
 	"chghost":           nil,
 	"extended-join":     nil,
 	"invite-notify":     nil,
+	"labeled-response":  nil,
 	"message-tags":      nil,
 	"msgid":             nil,
 	"multi-prefix":      nil,
@@ -30,16 +33,19 @@ var possibleCap = map[string][]string{
 
 	// Supported draft versions, some may be duplicated above, this is for backwards
 	// compatibility.
+	"draft/chathistory":      nil,
+	"draft/multiline":        nil,
 	"draft/message-tags-0.2": nil,
 	"draft/msgid":            nil,
 
 	// sts, sasl, etc are enabled dynamically/depending on client configuration,
 	// so aren't included on this list.
 
-	// "echo-message" is supported, but it's not enabled by default. This is
-	// to prevent unwanted confusion and utilize less traffic if it's not needed.
-	// echo messages aren't sent to girc.PRIVMSG and girc.NOTICE handlers,
-	// rather they are only sent to girc.ALL_EVENTS handlers (this is to prevent
+	// "echo-message" is supported, but it's not enabled by default (see
+	// Config.EchoMessage). This is to prevent unwanted confusion and utilize
+	// less traffic if it's not needed. echo messages aren't sent to
+	// girc.PRIVMSG and girc.NOTICE handlers, rather they are only sent to
+	// girc.ALL_EVENTS and girc.ECHO_PRIVMSG (etc) handlers (this is to prevent
 	// each handler to have to check these types of things for each message).
 	// You can compare events using Event.Equals() to see if they are the same.
 }
@@ -54,6 +60,102 @@ func (c *Client) listCAP() {
 	}
 }
 
+// endCAP lets the server know that we're done negotiating capabilities,
+// which allows registration to continue.
+func (c *Client) endCAP() {
+	c.mu.RLock()
+	if c.conn != nil {
+		c.conn.mu.Lock()
+		c.conn.capPending = false
+		c.conn.mu.Unlock()
+	}
+	c.mu.RUnlock()
+
+	c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+}
+
+// negotiatingCap returns true while capabilities are negotiated during
+// registration, i.e. until CAP END.
+func (c *Client) negotiatingCap() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.conn != nil && c.conn.negotiatingCap()
+}
+
+// negotiatingCap is like Client.negotiatingCap(), for a known connection.
+func (c *ircConn) negotiatingCap() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.capPending
+}
+
+// capEnabled returns true if the capability is enabled for the current
+// connection. Unlike Client.HasCapability(), this doesn't panic if tracking
+// is disabled.
+func (c *Client) capEnabled(name string) bool {
+	c.state.RLock()
+	_, ok := c.state.enabledCap[name]
+	c.state.RUnlock()
+
+	return ok
+}
+
+// ErrCapRejected is returned by Client.RequestCap() and Client.DropCap() if
+// the server rejected the request (with CAP NAK).
+type ErrCapRejected struct {
+	Caps []string // Caps are the capabilities which were requested.
+}
+
+func (e ErrCapRejected) Error() string {
+	return "capability request rejected by the server: " + strings.Join(e.Caps, " ")
+}
+
+// RequestCap requests the given capabilities from the server on a live
+// connection (e.g. ones which aren't requested by default, or which have
+// been advertised with CAP NEW), and waits for the server to acknowledge the
+// request. The server enables either all or none of the capabilities, and
+// ErrCapRejected is returned in the latter case. If ctx is done before then,
+// the error of ctx is returned. Will panic if used when tracking has been
+// disabled.
+//
+// Capabilities the server adds or removes later on (with cap-notify) are
+// passed to CAP_NEW_NOTIFY and CAP_DEL_NOTIFY handlers, as the params of the
+// event (as advertised, e.g. "sasl=PLAIN,EXTERNAL").
+func (c *Client) RequestCap(ctx context.Context, names ...string) error {
+	return c.requestCap(ctx, names)
+}
+
+// DropCap disables the given capabilities on a live connection, and waits
+// for the server to acknowledge it. See Client.RequestCap() for more
+// information.
+func (c *Client) DropCap(ctx context.Context, names ...string) error {
+	caps := make([]string, len(names))
+	for i := 0; i < len(names); i++ {
+		caps[i] = "-" + names[i]
+	}
+
+	return c.requestCap(ctx, caps)
+}
+
+// requestCap sends CAP REQ with the given list of capabilities, and waits
+// for the reply to it.
+func (c *Client) requestCap(ctx context.Context, caps []string) error {
+	c.panicIfNotTracking()
+
+	if len(caps) == 0 {
+		return nil
+	}
+
+	event := &Event{Command: CAP, Params: []string{CAP_REQ, strings.Join(caps, " ")}}
+	_, err := c.request(ctx, event, c.requests.addCap(caps))
+	return err
+}
+
+// possibleCapList returns the capabilities the client supports, mapped to
+// the supported values (if any). c.state must not be locked, as c.mu is
+// locked first.
 func possibleCapList(c *Client) map[string][]string {
 	out := make(map[string][]string)
 
@@ -61,17 +163,31 @@ func possibleCapList(c *Client) map[string][]string {
 		out["sasl"] = nil
 	}
 
-	if !c.Config.DisableSTS && !c.Config.SSL {
+	c.mu.RLock()
+	endpoint := c.activeEndpoint()
+	c.mu.RUnlock()
+
+	c.state.RLock()
+	lastFailed := c.state.sts.lastFailed
+	c.state.RUnlock()
+
+	// The upgrade port of an STS policy is the one of plain IRC, which
+	// doesn't apply to WebSocket connections.
+	if !c.Config.DisableSTS && !endpoint.SSL && endpoint.WebSocket == nil {
 		// If fallback supported, and we failed recently, don't try negotiating STS.
 		// ONLY do this fallback if we're expired (primarily useful during the first
 		// sts negotation).
-		if time.Since(c.state.sts.lastFailed) < 5*time.Minute && !c.Config.DisableSTSFallback {
+		if time.Since(lastFailed) < 5*time.Minute && !c.Config.DisableSTSFallback {
 			c.debug.Println("skipping strict transport policy negotiation; failed within the last 5 minutes")
 		} else {
 			out["sts"] = nil
 		}
 	}
 
+	if c.Config.EchoMessage {
+		out["echo-message"] = nil
+	}
+
 	for k := range c.Config.SupportedCaps {
 		out[k] = c.Config.SupportedCaps[k]
 	}
@@ -114,94 +230,189 @@ func parseCap(raw string) map[string]map[string]string {
 	return out
 }
 
+// wantedCaps returns the capabilities of the list advertised by the server
+// which should be requested. By default, these are the supported ones (see
+// possibleCapList), and if a list of values is given for them, only if the
+// server advertised one of them. See Config.HandleCap for overriding this.
+func (c *Client) wantedCaps(raw string) map[string]bool {
+	possible := possibleCapList(c)
+
+	caps := parseCap(raw)
+	wanted := make(map[string]bool)
+
+	for _, capName := range strings.Fields(raw) {
+		var value string
+		if i := strings.IndexByte(capName, prefixTagValue); i >= 0 {
+			capName, value = capName[:i], capName[i+1:]
+		}
+
+		supported, want := possible[capName]
+		if want && len(supported) > 0 && len(caps[capName]) > 0 {
+			want = false
+			for i := 0; i < len(supported); i++ {
+				if _, ok := caps[capName][supported[i]]; ok {
+					want = true
+					break
+				}
+			}
+		}
+
+		if c.Config.HandleCap != nil {
+			want = c.Config.HandleCap(capName, value, want)
+		}
+
+		if want {
+			wanted[capName] = true
+		}
+	}
+
+	return wanted
+}
+
+// requestCaps requests the capabilities collected in tmpCap, splitting them
+// across multiple CAP REQ lines if necessary. c.state must be locked.
+func (c *Client) requestCaps() {
+	names := make([]string, 0, len(c.state.tmpCap))
+	for capName := range c.state.tmpCap {
+		names = append(names, capName)
+	}
+	sort.Strings(names)
+
+	// "CAP REQ :" followed by the list.
+	max := maxLength - len(CAP) - len(CAP_REQ) - 3
+
+	var buffer string
+	for i := 0; i < len(names); i++ {
+		if len(buffer) > 0 && len(buffer)+1+len(names[i]) > max {
+			c.write(&Event{Command: CAP, Params: []string{CAP_REQ, buffer}})
+			c.state.capReqs++
+			buffer = ""
+		}
+
+		if len(buffer) == 0 {
+			buffer = names[i]
+		} else {
+			buffer += " " + names[i]
+		}
+	}
+
+	c.write(&Event{Command: CAP, Params: []string{CAP_REQ, buffer}})
+	c.state.capReqs++
+}
+
 // handleCAP attempts to find out what IRCv3 capabilities the server supports.
 // This will lock further registration until we have acknowledged (or denied)
 // the capabilities.
 func handleCAP(c *Client, e Event) {
+	// CAP_NEW_NOTIFY and CAP_DEL_NOTIFY are passed to handlers once the
+	// state has been unlocked, so they can make use of it.
+	var notify *Event
+	defer func() {
+		if notify != nil {
+			c.RunHandlers(notify)
+		}
+	}()
+
+	// Decide which of the advertised capabilities to request before
+	// locking the state, as Config.HandleCap may make use of it.
+	var wanted map[string]bool
+	if len(e.Params) >= 3 && (e.Params[1] == CAP_LS || e.Params[1] == CAP_NEW) {
+		wanted = c.wantedCaps(e.Last())
+	}
+
+	// Look up the connection before locking the state, as c.mu is always
+	// locked first.
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	// Some things are updated in the STS policy depending on if the current
+	// connection is over tls or not.
+	tlsState, _ := c.TLSConnectionState()
+	hasTLSConnection := tlsState != nil
+
 	c.state.Lock()
 	defer c.state.Unlock()
 
 	if len(e.Params) >= 2 && e.Params[1] == CAP_DEL {
 		caps := parseCap(e.Last())
 		for cap := range caps {
-			// TODO: test the deletion.
 			delete(c.state.enabledCap, cap)
+			delete(c.state.serverCaps, cap)
 		}
-		return
-	}
 
-	// We can assume there was a failure attempting to enable a capability.
-	if len(e.Params) >= 2 && e.Params[1] == CAP_NAK {
-		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		notify = &Event{Command: CAP_DEL_NOTIFY, Params: strings.Fields(e.Last())}
 		return
 	}
 
-	possible := possibleCapList(c)
-	// TODO: test the addition.
 	if len(e.Params) >= 3 && (e.Params[1] == CAP_LS || e.Params[1] == CAP_NEW) {
 		caps := parseCap(e.Last())
-
 		for capName := range caps {
-			if _, ok := possible[capName]; !ok {
-				continue
-			}
-
-			if len(possible[capName]) == 0 || len(caps[capName]) == 0 {
-				c.state.tmpCap[capName] = caps[capName]
-				continue
-			}
-
-			var contains bool
+			c.state.serverCaps[capName] = caps[capName]
+		}
 
-			for capAttr := range caps[capName] {
-				for i := 0; i < len(possible[capName]); i++ {
-					if _, ok := caps[capName][capAttr]; ok {
-						// Assuming we have a matching attribute for the capability.
-						contains = true
-						goto checkcontains
-					}
-				}
-			}
+		if e.Params[1] == CAP_NEW {
+			notify = &Event{Command: CAP_NEW_NOTIFY, Params: strings.Fields(e.Last())}
+		}
 
-		checkcontains:
-			if !contains {
-				continue
-			}
+		if e.Params[1] == CAP_LS && conn != nil {
+			conn.mu.Lock()
+			conn.capPending = true
+			conn.mu.Unlock()
+		}
 
+		for capName := range wanted {
 			c.state.tmpCap[capName] = caps[capName]
 		}
 
-		// Indicates if this is a multi-line LS. (3 args means it's the
-		// last LS).
-		if len(e.Params) == 3 {
-			// If we support no caps, just ack the CAP message and END.
-			if len(c.state.tmpCap) == 0 {
-				c.write(&Event{Command: CAP, Params: []string{CAP_END}})
-				return
-			}
+		// The list may be split across multiple lines, all but the last of
+		// which have a "*" parameter before the list.
+		if len(e.Params) > 3 && e.Params[2] == "*" {
+			return
+		}
 
-			// Let them know which ones we'd like to enable.
-			reqKeys := make([]string, len(c.state.tmpCap))
-			i := 0
-			for k := range c.state.tmpCap {
-				reqKeys[i] = k
-				i++
+		// If we support no caps, just ack the CAP message and END.
+		if len(c.state.tmpCap) == 0 {
+			if conn != nil && conn.negotiatingCap() {
+				c.endCAP()
 			}
-			c.write(&Event{Command: CAP, Params: []string{CAP_REQ, strings.Join(reqKeys, " ")}})
+			return
 		}
+
+		// Let them know which ones we'd like to enable.
+		c.requestCaps()
+		return
 	}
 
-	if len(e.Params) == 3 && e.Params[1] == CAP_ACK {
-		enabled := strings.Split(e.Last(), " ")
-		for _, cap := range enabled {
-			if val, ok := c.state.tmpCap[cap]; ok {
-				c.state.enabledCap[cap] = val
-			} else {
-				c.state.enabledCap[cap] = nil
+	if len(e.Params) >= 3 && (e.Params[1] == CAP_ACK || e.Params[1] == CAP_NAK) {
+		// If the server rejects the request (NAK), none of the capabilities
+		// are enabled.
+		if e.Params[1] == CAP_ACK {
+			for _, cap := range strings.Fields(e.Last()) {
+				if cap[0] == '-' {
+					delete(c.state.enabledCap, cap[1:])
+					continue
+				}
+
+				if val, ok := c.state.tmpCap[cap]; ok {
+					c.state.enabledCap[cap] = val
+				} else {
+					c.state.enabledCap[cap] = c.state.serverCaps[cap]
+				}
 			}
 		}
 
+		if c.requests.receiveCap(&e) {
+			// Requested with Client.RequestCap() or Client.DropCap().
+			return
+		}
+
+		// Wait for the replies to all of the CAP REQ lines.
+		if c.state.capReqs--; c.state.capReqs > 0 {
+			return
+		}
+		c.state.capReqs = 0
+
 		// Anything client side that needs to be setup post-capability-acknowledgement,
 		// should be done here.
 
@@ -210,13 +421,6 @@ func handleCAP(c *Client, e Event) {
 		if sts, sok := c.state.enabledCap["sts"]; sok && !c.Config.DisableSTS {
 			var isError bool
 
-			// Some things are updated in the policy depending on if the current
-			// connection is over tls or not.
-			var hasTLSConnection bool
-			if tlsState, _ := c.TLSConnectionState(); tlsState != nil {
-				hasTLSConnection = true
-			}
-
 			// "This key indicates the port number for making a secure connection.
 			// This key’s value MUST be a single port number. If the client is not
 			// already connected securely to the server at the requested hostname,
@@ -261,11 +465,16 @@ func handleCAP(c *Client, e Event) {
 
 			// See: https://ircv3.net/specs/extensions/sts#the-preload-key
 			if hasTLSConnection {
-				if preload, ok := sts["preload"]; ok {
-					c.state.sts.preload, _ = strconv.ParseBool(preload)
+				if _, ok := sts["preload"]; ok {
+					// The preload key has no value.
+					c.state.sts.preload = true
 				}
 			}
 
+			if hasTLSConnection && !isError {
+				c.saveSTSPolicy(c.state.sts.persistenceDuration, c.state.sts.preload)
+			}
+
 			if isError {
 				c.rx <- &Event{Command: ERROR, Params: []string{
 					fmt.Sprintf("closing connection: strict transport policy provided by server is invalid; possible MITM? config: %#v", sts),
@@ -288,14 +497,25 @@ func handleCAP(c *Client, e Event) {
 		// due to cap-notify, we can re-evaluate what we can support.
 		c.state.tmpCap = make(map[string]map[string]string)
 
-		if _, ok := c.state.enabledCap["sasl"]; ok && c.Config.SASL != nil {
-			c.write(&Event{Command: AUTHENTICATE, Params: []string{c.Config.SASL.Method()}})
-			// Don't "CAP END", since we want to authenticate.
+		if conn == nil || !conn.negotiatingCap() {
+			// Capabilities advertised with CAP NEW after registration.
 			return
 		}
 
+		if _, ok := c.state.enabledCap["sasl"]; ok && c.Config.SASL != nil {
+			if c.startSASL(saslMechs(c.Config.SASL), nil) {
+				// Don't "CAP END", since we want to authenticate.
+				return
+			}
+
+			if !c.Config.SASLOptional {
+				c.saslFailed(c.Config.SASL, e, "no mechanism is supported by the server")
+				return
+			}
+		}
+
 		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		c.endCAP()
 		return
 	}
 }
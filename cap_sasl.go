@@ -5,12 +5,29 @@
 package girc
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
+)
+
+var (
+	// ErrSASLDisabled is returned by Client.Reauthenticate() if the sasl
+	// capability isn't enabled.
+	ErrSASLDisabled = errors.New("sasl is not enabled")
+	// ErrSASLInProgress is returned by Client.Reauthenticate() if SASL
+	// authentication is in progress already.
+	ErrSASLInProgress = errors.New("sasl authentication is already in progress")
+	// ErrSASLUnsupported is returned by Client.Reauthenticate() if the
+	// server doesn't support any of the given mechanisms.
+	ErrSASLUnsupported = errors.New("sasl mechanisms are not supported by the server")
 )
 
 // SASLMech is an representation of what a SASL mechanism should support.
-// See SASLExternal and SASLPlain for implementations of this.
+// See SASLExternal, SASLPlain and SASLScramSHA256 for implementations of
+// this. Mechanisms which exchange more than a single message with the server
+// should implement SASLStatefulMech as well.
 type SASLMech interface {
 	// Method returns the uppercase version of the SASL mechanism name.
 	Method() string
@@ -21,6 +38,177 @@ type SASLMech interface {
 	Encode(params []string) (output string)
 }
 
+// SASLStatefulMech is a SASLMech which exchanges multiple challenges and
+// responses with the server (e.g. SCRAM), and has to keep state in between.
+// If the mechanism implements it, Start is used instead of Encode.
+type SASLStatefulMech interface {
+	SASLMech
+	// Start begins a new authentication exchange with the server.
+	Start() SASLExchange
+}
+
+// SASLExchange is a single authentication exchange of a SASLStatefulMech.
+type SASLExchange interface {
+	// Next returns the response to a challenge from the server. Both are
+	// raw, i.e. not base64 encoded, and the first challenge is usually
+	// empty. If an error is returned, authentication fails.
+	Next(challenge []byte) (response []byte, err error)
+	// Done returns true if the exchange is complete on the client side, e.g.
+	// once the server has proven its identity. Authentication fails if the
+	// server reports success before then.
+	Done() bool
+}
+
+// SASLMechs is an ordered list of SASL mechanisms, which can be used as
+// Config.SASL. The mechanisms are tried in order, skipping those which the
+// server doesn't support, until authentication succeeds (see
+// Config.SASLOptional for when it doesn't).
+type SASLMechs []SASLMech
+
+// Method returns the method of the first mechanism.
+func (sasl SASLMechs) Method() string {
+	if len(sasl) == 0 {
+		return ""
+	}
+
+	return sasl[0].Method()
+}
+
+// Encode uses the first mechanism. Each of the mechanisms are used as
+// needed during authentication instead.
+func (sasl SASLMechs) Encode(params []string) string {
+	if len(sasl) == 0 {
+		return ""
+	}
+
+	return sasl[0].Encode(params)
+}
+
+// saslMechs returns the list of mechanisms mech stands for.
+func saslMechs(mech SASLMech) (mechs []SASLMech) {
+	list, ok := mech.(SASLMechs)
+	if !ok {
+		if mech != nil {
+			mechs = append(mechs, mech)
+		}
+		return mechs
+	}
+
+	for i := 0; i < len(list); i++ {
+		mechs = append(mechs, saslMechs(list[i])...)
+	}
+
+	return mechs
+}
+
+// saslSupported returns the mechanisms of mechs which are supported by the
+// server, according to the list of supported methods.
+func saslSupported(mechs []SASLMech, supported []string) (out []SASLMech) {
+	for i := 0; i < len(mechs); i++ {
+		for j := 0; j < len(supported); j++ {
+			if strings.EqualFold(mechs[i].Method(), supported[j]) {
+				out = append(out, mechs[i])
+				break
+			}
+		}
+	}
+
+	return out
+}
+
+// saslState is the state of the SASL authentication in progress.
+type saslState struct {
+	mech SASLMech
+	// exchange is the exchange in progress, if mech is a SASLStatefulMech.
+	exchange SASLExchange
+	// challenge is the base64 encoded challenge received so far, if the
+	// server splits it into multiple chunks.
+	challenge string
+	// next are the mechanisms to try if authentication with mech fails.
+	next []SASLMech
+	// aborted is the reason we aborted the exchange for, if we did.
+	aborted string
+	// result receives the outcome of a reauthentication (see
+	// Client.Reauthenticate). It's nil during registration.
+	result chan error
+}
+
+// startSASL begins authenticating with the first of mechs which the server
+// supports, as far as known. It returns false if there is none. c.state
+// must be locked.
+func (c *Client) startSASL(mechs []SASLMech, result chan error) bool {
+	if supported := c.state.enabledCap["sasl"]; len(supported) > 0 {
+		methods := make([]string, 0, len(supported))
+		for method := range supported {
+			methods = append(methods, method)
+		}
+
+		mechs = saslSupported(mechs, methods)
+	}
+
+	if len(mechs) == 0 {
+		c.state.sasl = nil
+		return false
+	}
+
+	c.state.sasl = &saslState{mech: mechs[0], next: mechs[1:], result: result}
+	if stateful, ok := mechs[0].(SASLStatefulMech); ok {
+		c.state.sasl.exchange = stateful.Start()
+	}
+
+	c.write(&Event{Command: AUTHENTICATE, Params: []string{mechs[0].Method()}})
+	return true
+}
+
+// saslNext continues with the next mechanism, as authentication with
+// sasl.mech failed, or gives up if there is none.
+func (c *Client) saslNext(sasl *saslState, e Event, reason string) {
+	c.state.Lock()
+	if c.state.sasl != sasl {
+		// The authentication has been cancelled in the mean time.
+		c.state.Unlock()
+		return
+	}
+	started := c.startSASL(sasl.next, sasl.result)
+	c.state.Unlock()
+
+	mech := sasl.mech
+	if started {
+		c.debug.Printf("SASL %s failed: %s; trying next mechanism", mech.Method(), reason)
+		return
+	}
+
+	if sasl.result != nil {
+		sasl.result <- ErrSASLFailed{Method: mech.Method(), Event: e.Copy()}
+		return
+	}
+
+	if c.Config.SASLOptional {
+		c.debug.Printf("SASL %s failed: %s; continuing unauthenticated", mech.Method(), reason)
+		c.endCAP()
+		return
+	}
+
+	c.saslFailed(mech, e, reason)
+}
+
+// saslAbort aborts the exchange with the server. The server confirms this
+// with ERR_SASLABORTED, after which the next mechanism is tried.
+func (c *Client) saslAbort(sasl *saslState, reason string) {
+	sasl.aborted = reason
+	c.write(&Event{Command: AUTHENTICATE, Params: []string{"*"}})
+}
+
+// saslFailed aborts registration, as authentication with mech failed.
+func (c *Client) saslFailed(mech SASLMech, e Event, reason string) {
+	// The SASL spec and IRCv3 spec do not define a clear way to abort a SASL
+	// exchange, other than to disconnect, or proceed with CAP END.
+	c.registrationFailed(ErrSASLFailed{Method: mech.Method(), Event: e.Copy()})
+	c.rx <- &Event{Command: ERROR, Params: []string{
+		fmt.Sprintf("closing connection: SASL %s failed: %s", mech.Method(), reason),
+	}}
+}
+
 // SASLExternal implements the "EXTERNAL" SASL type.
 type SASLExternal struct {
 	// Identity is an optional field which allows the client to specify
@@ -81,23 +269,94 @@ func (sasl *SASLPlain) Encode(params []string) string {
 const saslChunkSize = 400
 
 func handleSASL(c *Client, e Event) {
+	c.state.Lock()
+	sasl := c.state.sasl
+	if e.Command != AUTHENTICATE {
+		c.state.sasl = nil
+	}
+	c.state.Unlock()
+
 	if e.Command == RPL_SASLSUCCESS || e.Command == ERR_SASLALREADY {
-		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		if e.Command == RPL_SASLSUCCESS && sasl != nil && sasl.exchange != nil && !sasl.exchange.Done() {
+			if sasl.result != nil {
+				sasl.result <- ErrSASLFailed{Method: sasl.mech.Method(), Event: e.Copy()}
+				return
+			}
+
+			c.saslFailed(sasl.mech, e, "server reported success before completing the exchange")
+			return
+		}
+
+		if sasl != nil && sasl.result != nil {
+			var err error
+			if e.Command == ERR_SASLALREADY {
+				// The server doesn't support reauthentication.
+				err = ErrSASLFailed{Method: sasl.mech.Method(), Event: e.Copy()}
+			}
+
+			sasl.result <- err
+			return
+		}
+
+		if !c.registered() {
+			// Let the server know that we're done.
+			c.endCAP()
+		}
+		return
+	}
+
+	if sasl == nil || sasl.aborted != "" || len(e.Params) == 0 {
+		// Not authenticating.
 		return
 	}
 
-	// Assume they want us to handle sending auth.
-	auth := c.Config.SASL.Encode(e.Params)
+	// Challenges longer than "saslChunkSize" bytes are split into multiple
+	// chunks, the last of which is shorter (or "+").
+	if chunk := e.Params[0]; chunk != "+" {
+		sasl.challenge += chunk
+		if len(chunk) == saslChunkSize {
+			return
+		}
+	}
+
+	params := e.Params
+	if sasl.challenge != "" {
+		params = []string{sasl.challenge}
+		sasl.challenge = ""
+	}
+
+	var auth string
+	if sasl.exchange == nil {
+		// Assume they want us to handle sending auth.
+		auth = sasl.mech.Encode(params)
+	} else {
+		var challenge []byte
+		var err error
+
+		if params[0] != "+" {
+			challenge, err = base64.StdEncoding.DecodeString(params[0])
+		}
+
+		var response []byte
+		if err == nil {
+			response, err = sasl.exchange.Next(challenge)
+		}
+
+		if err != nil {
+			c.saslAbort(sasl, err.Error())
+			return
+		}
+
+		auth = "+"
+		if len(response) > 0 {
+			auth = base64.StdEncoding.EncodeToString(response)
+		}
+	}
 
 	if auth == "" {
 		// Assume the SASL authentication method doesn't want to respond for
-		// some reason. The SASL spec and IRCv3 spec do not define a clear
-		// way to abort a SASL exchange, other than to disconnect, or proceed
-		// with CAP END.
-		c.rx <- &Event{Command: ERROR, Params: []string{
-			fmt.Sprintf("closing connection: SASL %s failed: %s", c.Config.SASL.Method(), e.Last()),
-		}}
+		// some reason.
+		c.saslAbort(sasl, "no response to challenge")
 		return
 	}
 
@@ -106,31 +365,103 @@ func handleSASL(c *Client, e Event) {
 	// acknowledgement response to let the server know that we're done.
 	for {
 		if len(auth) > saslChunkSize {
-			c.write(&Event{Command: AUTHENTICATE, Params: []string{auth[0 : saslChunkSize-1]}, Sensitive: true})
+			c.write(&Event{Command: AUTHENTICATE, Params: []string{auth[:saslChunkSize]}, Sensitive: true})
 			auth = auth[saslChunkSize:]
 			continue
 		}
 
-		if len(auth) <= saslChunkSize {
-			c.write(&Event{Command: AUTHENTICATE, Params: []string{auth}, Sensitive: true})
+		c.write(&Event{Command: AUTHENTICATE, Params: []string{auth}, Sensitive: true})
 
-			if len(auth) == 400 {
-				c.write(&Event{Command: AUTHENTICATE, Params: []string{"+"}})
-			}
-			break
+		if len(auth) == saslChunkSize {
+			c.write(&Event{Command: AUTHENTICATE, Params: []string{"+"}})
 		}
+		break
 	}
-	return
 }
 
 func handleSASLError(c *Client, e Event) {
-	if c.Config.SASL == nil {
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+	c.state.Lock()
+	sasl := c.state.sasl
+	if sasl != nil {
+		switch e.Command {
+		case RPL_SASLMECHS:
+			// Only try the mechanisms the server supports from now on. The
+			// failure of the current one follows.
+			if len(e.Params) > 1 {
+				sasl.next = saslSupported(sasl.next, strings.Split(e.Params[1], ","))
+			}
+			c.state.Unlock()
+			return
+		case RPL_NICKLOCKED:
+			// The account is unavailable, regardless of the mechanism.
+			sasl.next = nil
+		}
+	}
+	c.state.Unlock()
+
+	if sasl == nil {
+		// Unless authentication has failed (or been cancelled) already.
+		if c.Config.SASL == nil && !c.registered() {
+			c.endCAP()
+		}
 		return
 	}
 
-	// Authentication failed. The SASL spec and IRCv3 spec do not define a
-	// clear way to abort a SASL exchange, other than to disconnect, or
-	// proceed with CAP END.
-	c.rx <- &Event{Command: ERROR, Params: []string{"closing connection: " + e.Last()}}
+	reason := e.Last()
+	if sasl.aborted != "" {
+		reason = sasl.aborted
+	}
+
+	c.saslNext(sasl, e, reason)
+}
+
+// Reauthenticate authenticates with the server using SASL on an
+// established connection, e.g. to switch accounts, or to identify again
+// after services have been restarted. mech may be SASLMechs to try multiple
+// mechanisms in order. The client must be registered with the server, and
+// the sasl capability must be enabled (see Config.SASL), otherwise
+// ErrNotConnected and ErrSASLDisabled are returned respectively.
+//
+// ErrSASLFailed is returned if the server rejects authentication with all
+// of the mechanisms, and ErrSASLUnsupported if it doesn't support any of
+// them. Unlike during registration, the client stays connected in either
+// case. If ctx is done before the exchange is complete, it's aborted, and
+// the error of ctx is returned.
+func (c *Client) Reauthenticate(ctx context.Context, mech SASLMech) error {
+	if !c.registered() {
+		return ErrNotConnected
+	}
+
+	if !c.capEnabled("sasl") {
+		return ErrSASLDisabled
+	}
+
+	result := make(chan error, 1)
+
+	c.state.Lock()
+	if c.state.sasl != nil {
+		c.state.Unlock()
+		return ErrSASLInProgress
+	}
+
+	started := c.startSASL(saslMechs(mech), result)
+	c.state.Unlock()
+
+	if !started {
+		return ErrSASLUnsupported
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		c.state.Lock()
+		if c.state.sasl != nil && c.state.sasl.result == result {
+			c.state.sasl = nil
+			c.write(&Event{Command: AUTHENTICATE, Params: []string{"*"}})
+		}
+		c.state.Unlock()
+
+		return ctx.Err()
+	}
 }
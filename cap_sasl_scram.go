@@ -0,0 +1,234 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SASLScramSHA256 implements the "SCRAM-SHA-256" SASL type. Unlike PLAIN,
+// the password is never sent to the server, and the server has to prove that
+// it knows the password as well. See https://tools.ietf.org/html/rfc7677.
+type SASLScramSHA256 struct {
+	User string `json:"user"` // User is the username for SASL.
+	Pass string `json:"pass"` // Pass is the password for SASL.
+}
+
+// Method identifies what type of SASL this implements.
+func (sasl *SASLScramSHA256) Method() string {
+	return "SCRAM-SHA-256"
+}
+
+// Encode isn't used, as SCRAM requires multiple steps. See Start.
+func (sasl *SASLScramSHA256) Encode(params []string) string {
+	return ""
+}
+
+// Start begins a new SCRAM-SHA-256 authentication exchange.
+func (sasl *SASLScramSHA256) Start() SASLExchange {
+	return &scramExchange{hash: sha256.New, user: sasl.User, pass: sasl.Pass}
+}
+
+// SASLScramSHA1 implements the "SCRAM-SHA-1" SASL type. Prefer
+// SASLScramSHA256 if the server supports it. See
+// https://tools.ietf.org/html/rfc5802.
+type SASLScramSHA1 struct {
+	User string `json:"user"` // User is the username for SASL.
+	Pass string `json:"pass"` // Pass is the password for SASL.
+}
+
+// Method identifies what type of SASL this implements.
+func (sasl *SASLScramSHA1) Method() string {
+	return "SCRAM-SHA-1"
+}
+
+// Encode isn't used, as SCRAM requires multiple steps. See Start.
+func (sasl *SASLScramSHA1) Encode(params []string) string {
+	return ""
+}
+
+// Start begins a new SCRAM-SHA-1 authentication exchange.
+func (sasl *SASLScramSHA1) Start() SASLExchange {
+	return &scramExchange{hash: sha1.New, user: sasl.User, pass: sasl.Pass}
+}
+
+// scramGS2Header is the GS2 header of the client messages, as channel
+// binding isn't supported.
+const scramGS2Header = "n,,"
+
+// scramMaxIterations is the maximum iteration count accepted from the
+// server, so a hostile server can't make the client compute the salted
+// password for an unbounded amount of time.
+const scramMaxIterations = 1 << 20
+
+// scramExchange is a single SCRAM authentication exchange. Channel binding
+// and SASLprep are not supported, so passwords should be ASCII.
+type scramExchange struct {
+	hash       func() hash.Hash
+	user, pass string
+
+	// step is the amount of challenges handled so far.
+	step int
+	// nonce is the client nonce.
+	nonce string
+	// clientFirst is the client-first-message-bare.
+	clientFirst string
+	// serverSignature is the signature the server has to prove its identity
+	// with.
+	serverSignature []byte
+	done            bool
+}
+
+func (s *scramExchange) Next(challenge []byte) ([]byte, error) {
+	s.step++
+
+	switch s.step {
+	case 1:
+		return s.first()
+	case 2:
+		return s.final(string(challenge))
+	case 3:
+		return nil, s.verify(string(challenge))
+	}
+
+	return nil, errors.New("scram: unexpected challenge")
+}
+
+func (s *scramExchange) Done() bool {
+	return s.done
+}
+
+// first returns the client-first-message.
+func (s *scramExchange) first() ([]byte, error) {
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.nonce = base64.RawStdEncoding.EncodeToString(nonce)
+
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	s.clientFirst = "n=" + user + ",r=" + s.nonce
+
+	return []byte(scramGS2Header + s.clientFirst), nil
+}
+
+// final returns the client-final-message, in response to the
+// server-first-message.
+func (s *scramExchange) final(serverFirst string) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("scram: unsupported mandatory extension")
+	}
+
+	nonce := attrs['r']
+	if len(nonce) <= len(s.nonce) || !strings.HasPrefix(nonce, s.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("scram: invalid salt")
+	}
+
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("scram: invalid iteration count %q", attrs['i'])
+	}
+
+	if iterations > scramMaxIterations {
+		return nil, fmt.Errorf("scram: iteration count %d exceeds the maximum of %d", iterations, scramMaxIterations)
+	}
+
+	salted := s.saltPassword(salt, iterations)
+	clientKey := s.hmac(salted, "Client Key")
+	storedKey := s.hash()
+	storedKey.Write(clientKey)
+
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	authMessage := s.clientFirst + "," + serverFirst + "," + clientFinal
+
+	proof := s.hmac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	s.serverSignature = s.hmac(s.hmac(salted, "Server Key"), authMessage)
+
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify verifies the server-final-message.
+func (s *scramExchange) verify(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs['e']; ok {
+		return errors.New("scram: server error: " + e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(signature, s.serverSignature) {
+		return errors.New("scram: invalid server signature")
+	}
+
+	s.done = true
+	return nil
+}
+
+// hmac returns the HMAC of data with key.
+func (s *scramExchange) hmac(key []byte, data string) []byte {
+	mac := hmac.New(s.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// saltPassword returns the salted password, i.e. Hi(password, salt, i),
+// which is PBKDF2 with HMAC as the pseudorandom function, and the output
+// length of the hash.
+func (s *scramExchange) saltPassword(salt []byte, iterations int) []byte {
+	mac := hmac.New(s.hash, []byte(s.pass))
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+
+	out := make([]byte, len(u))
+	copy(out, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+
+	return out
+}
+
+// scramAttrs parses the attributes of a SCRAM message, e.g.
+// "r=nonce,s=salt,i=4096".
+func scramAttrs(message string) map[byte]string {
+	attrs := make(map[byte]string)
+
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+
+		attrs[attr[0]] = attr[2:]
+	}
+
+	return attrs
+}
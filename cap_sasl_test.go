@@ -0,0 +1,260 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSCRAM(t *testing.T) {
+	// Test vectors from RFC 5802 and RFC 7677.
+	tests := []struct {
+		mech        SASLStatefulMech
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			mech:        &SASLScramSHA1{User: "user", Pass: "pencil"},
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			mech:        &SASLScramSHA256{User: "user", Pass: "pencil"},
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+
+	for _, tt := range tests {
+		exchange := tt.mech.Start().(*scramExchange)
+
+		first, err := exchange.Next(nil)
+		if err != nil || !strings.HasPrefix(string(first), "n,,n=user,r=") {
+			t.Fatalf("[%s] client-first-message == %q, %v", tt.mech.Method(), first, err)
+		}
+
+		// Replace the random nonce with the one of the test vector.
+		exchange.nonce = tt.nonce
+		exchange.clientFirst = "n=user,r=" + tt.nonce
+
+		final, err := exchange.Next([]byte(tt.serverFirst))
+		if err != nil || string(final) != tt.clientFinal {
+			t.Fatalf("[%s] client-final-message == %q, %v, want %q", tt.mech.Method(), final, err, tt.clientFinal)
+		}
+
+		if exchange.Done() {
+			t.Fatalf("[%s] exchange done before verifying the server", tt.mech.Method())
+		}
+
+		if _, err = exchange.Next([]byte(tt.serverFinal)); err != nil || !exchange.Done() {
+			t.Fatalf("[%s] verifying server-final-message == %v", tt.mech.Method(), err)
+		}
+	}
+
+	exchange := (&SASLScramSHA256{User: "user", Pass: "pencil"}).Start().(*scramExchange)
+	exchange.Next(nil)
+	exchange.nonce = "rOprNGfwEbeRWgbNEkqO"
+	exchange.clientFirst = "n=user,r=" + exchange.nonce
+	exchange.Next([]byte(tests[1].serverFirst))
+
+	if _, err := exchange.Next([]byte(tests[0].serverFinal)); err == nil || exchange.Done() {
+		t.Fatal("invalid server signature was accepted")
+	}
+	exchange = (&SASLScramSHA256{User: "user", Pass: "pencil"}).Start().(*scramExchange)
+	exchange.Next(nil)
+	serverFirst := "r=" + exchange.nonce + "server,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=" + strconv.Itoa(scramMaxIterations+1)
+
+	if _, err := exchange.Next([]byte(serverFirst)); err == nil {
+		t.Fatal("iteration count above the maximum was accepted")
+	}
+}
+
+// mockSASLMech is a SASLStatefulMech which records the challenges it
+// receives.
+type mockSASLMech struct {
+	challenges chan string
+}
+
+func (m *mockSASLMech) Method() string                { return "MOCK" }
+func (m *mockSASLMech) Encode(params []string) string { return "" }
+func (m *mockSASLMech) Start() SASLExchange           { return &mockSASLExchange{mech: m} }
+
+type mockSASLExchange struct {
+	mech *mockSASLMech
+	done bool
+}
+
+func (e *mockSASLExchange) Next(challenge []byte) ([]byte, error) {
+	e.mech.challenges <- string(challenge)
+	e.done = len(challenge) > 0
+	return []byte(strings.Repeat("r", len(challenge))), nil
+}
+
+func (e *mockSASLExchange) Done() bool { return e.done }
+
+func TestSASLStateful(t *testing.T) {
+	mech := &mockSASLMech{challenges: make(chan string, 10)}
+
+	// Long enough to be split into two chunks in both directions.
+	challenge := strings.Repeat("c", 350)
+	encoded := base64.StdEncoding.EncodeToString([]byte(challenge))
+
+	responses := make(chan string, 10)
+	c, server := mockRegistered(t, "sasl", func(e *Event) []string {
+		if e.Command != AUTHENTICATE {
+			return nil
+		}
+
+		if e.Params[0] == "MOCK" {
+			return []string{"AUTHENTICATE +"}
+		}
+
+		responses <- e.Params[0]
+		if e.Params[0] == "+" {
+			return []string{"AUTHENTICATE " + encoded[:saslChunkSize], "AUTHENTICATE " + encoded[saslChunkSize:]}
+		}
+
+		if len(e.Params[0]) < saslChunkSize {
+			return []string{":dummy.int 903 test :SASL authentication successful"}
+		}
+		return nil
+	}, func(c *Client) { c.Config.SASL = mech })
+	defer c.Close()
+	defer server.Close()
+
+	if got := <-mech.challenges; got != "" {
+		t.Fatalf("first challenge == %q, want empty", got)
+	}
+
+	if got := <-mech.challenges; got != challenge {
+		t.Fatalf("second challenge == %q, want %q", got, challenge)
+	}
+
+	want := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("r", len(challenge))))
+	got := []string{<-responses, <-responses, <-responses}
+	if got[0] != "+" || got[1]+got[2] != want || len(got[1]) != saslChunkSize {
+		t.Fatalf("responses == %q, want \"+\" and %q in chunks", got, want)
+	}
+}
+
+func TestSASLFallback(t *testing.T) {
+	tests := []struct {
+		caps     string
+		mechs    string
+		optional bool
+		want     []string
+	}{
+		// The list of mechanisms is advertised with the capability.
+		{caps: "sasl=PLAIN,EXTERNAL", mechs: "PLAIN,EXTERNAL", want: []string{"EXTERNAL", "PLAIN"}},
+		// The list of mechanisms is sent once the first one fails.
+		{caps: "sasl", mechs: "PLAIN", want: []string{"SCRAM-SHA-256", "PLAIN"}},
+		// None of the mechanisms succeed.
+		{caps: "sasl=EXTERNAL", mechs: "EXTERNAL", optional: true, want: []string{"EXTERNAL"}},
+	}
+
+	for _, tt := range tests {
+		methods := make(chan string, 10)
+		c, server := mockRegistered(t, tt.caps, func(e *Event) []string {
+			if e.Command != AUTHENTICATE {
+				return nil
+			}
+
+			switch e.Params[0] {
+			case "PLAIN":
+				methods <- e.Params[0]
+				return []string{":dummy.int 903 test :SASL authentication successful"}
+			case "EXTERNAL", "SCRAM-SHA-256":
+				methods <- e.Params[0]
+				return []string{
+					":dummy.int 908 test " + tt.mechs + " :are available SASL mechanisms",
+					":dummy.int 904 test :SASL authentication failed",
+				}
+			}
+			return nil
+		}, func(c *Client) {
+			c.Config.SASL = SASLMechs{
+				&SASLScramSHA256{User: "user", Pass: "pass"},
+				&SASLExternal{},
+				&SASLPlain{User: "user", Pass: "pass"},
+			}
+			c.Config.SASLOptional = tt.optional
+		})
+
+		var got []string
+		for len(methods) > 0 {
+			got = append(got, <-methods)
+		}
+
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Fatalf("[%s] tried %q, want %q", tt.caps, got, tt.want)
+		}
+
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	ends := make(chan struct{}, 10)
+	users := make(chan string, 10)
+	c, server := mockRegistered(t, "sasl", func(e *Event) []string {
+		switch e.Command {
+		case CAP:
+			if e.Params[0] == CAP_END {
+				ends <- struct{}{}
+			}
+		case AUTHENTICATE:
+			switch e.Params[0] {
+			case "PLAIN":
+				return []string{"AUTHENTICATE +"}
+			case "EXTERNAL":
+				return []string{":dummy.int 904 test :SASL authentication failed"}
+			}
+
+			raw, _ := base64.StdEncoding.DecodeString(e.Params[0])
+			users <- strings.Split(string(raw), "\x00")[0]
+			return []string{":dummy.int 903 test :SASL authentication successful"}
+		}
+		return nil
+	}, func(c *Client) { c.Config.SASL = &SASLPlain{User: "user", Pass: "pass"} })
+	defer c.Close()
+	defer server.Close()
+
+	if user := <-users; user != "user" {
+		t.Fatalf("authenticated as %q during registration, want user", user)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.Reauthenticate(ctx, SASLMechs{&SASLExternal{}, &SASLPlain{User: "other", Pass: "pass"}})
+	if err != nil {
+		t.Fatalf("Client.Reauthenticate() == %v", err)
+	}
+
+	if user := <-users; user != "other" {
+		t.Fatalf("reauthenticated as %q, want other", user)
+	}
+
+	err = c.Reauthenticate(ctx, &SASLExternal{})
+	if e, ok := err.(ErrSASLFailed); !ok || e.Method != "EXTERNAL" || e.Event.Command != ERR_SASLFAIL {
+		t.Fatalf("Client.Reauthenticate() == %v, want ErrSASLFailed", err)
+	}
+
+	if !c.IsConnected() || len(ends) != 1 {
+		t.Fatalf("client disconnected or sent CAP END %d times after reauthenticating", len(ends))
+	}
+}
@@ -6,10 +6,12 @@ package girc
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // handleTags handles any messages that have tags that will affect state. (e.g.
@@ -33,6 +35,29 @@ func handleTags(c *Client, e Event) {
 	c.state.notify(c, UPDATE_STATE)
 }
 
+// ErrMessageTagsDisabled is returned by commands which only send tags (like
+// Commands.TagMsg()) if the message-tags capability isn't enabled.
+var ErrMessageTagsDisabled = errors.New("message-tags is not enabled")
+
+// Client-only tags, see https://ircv3.net/specs/extensions/message-tags.
+const (
+	// TagReply is the msgid of the message a message is a reply to.
+	TagReply = "+draft/reply"
+	// TagReact is a reaction (e.g. an emoji) to a message, sent with
+	// TagReply set to the msgid of the message.
+	TagReact = "+draft/react"
+	// TagTyping is the typing state of the sender, one of TypingActive,
+	// TypingPaused and TypingDone.
+	TagTyping = "+typing"
+)
+
+// Typing states, see Commands.Typing().
+const (
+	TypingActive = "active"
+	TypingPaused = "paused"
+	TypingDone   = "done"
+)
+
 const (
 	prefixTag      byte = '@'
 	prefixTagValue byte = '='
@@ -311,11 +336,33 @@ func validTag(name string) bool {
 // validTagValue valids a decoded IRC tag value. If the value is not decoded
 // with tagDecoder first, it may be seen as invalid.
 func validTagValue(value string) bool {
+	// Values may contain UTF-8 characters, like emoji reactions (see
+	// TagReact).
+	if !utf8.ValidString(value) {
+		return false
+	}
+
 	for i := 0; i < len(value); i++ {
 		// Don't allow any invisible chars within the tag, or semicolons.
-		if value[i] < '!' || value[i] > '~' || value[i] == ';' {
+		if value[i] < '!' || value[i] == 0x7f || value[i] == ';' {
 			return false
 		}
 	}
 	return true
 }
+
+// MsgID returns the ID the server assigned to the event (see the msgid
+// tag), if any. This requires the message-tags capability.
+func (e *Event) MsgID() (msgid string, ok bool) {
+	if msgid, ok = e.Tags.Get("msgid"); ok {
+		return msgid, ok
+	}
+
+	return e.Tags.Get("draft/msgid")
+}
+
+// ReplyTo returns the msgid of the message the event is a reply to (see
+// TagReply), if any. This requires the message-tags capability.
+func (e *Event) ReplyTo() (msgid string, ok bool) {
+	return e.Tags.Get(TagReply)
+}
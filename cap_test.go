@@ -5,8 +5,12 @@
 package girc
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCapSupported(t *testing.T) {
@@ -107,4 +111,230 @@ func TestTagGetSetCount(t *testing.T) {
 	if err := e.Tags.Set("key", "invalid-value\b"); err == nil {
 		t.Fatal("tag set of invalid value should have returned error")
 	}
+
+	if err := e.Tags.Set("+draft/react", "\U0001F44D"); err != nil {
+		t.Fatalf("tag set of UTF-8 value returned error: %v", err)
+	}
+}
+
+func TestClientTags(t *testing.T) {
+	e := ParseEvent("@msgid=abc;+draft/reply=def :nick!user@host PRIVMSG #channel :hello")
+	if msgid, ok := e.MsgID(); !ok || msgid != "abc" {
+		t.Fatalf("Event.MsgID() == %q, %v, want abc", msgid, ok)
+	}
+
+	if msgid, ok := e.ReplyTo(); !ok || msgid != "def" {
+		t.Fatalf("Event.ReplyTo() == %q, %v, want def", msgid, ok)
+	}
+
+	for _, caps := range []string{"", "message-tags"} {
+		sent := make(chan string, 10)
+		c, server := mockRegistered(t, caps, func(e *Event) []string {
+			if e.Command == PRIVMSG || e.Command == CAP_TAGMSG {
+				sent <- e.String()
+			}
+			return nil
+		})
+
+		if caps == "" {
+			if err := c.Cmd.Typing("#channel", TypingActive); err != ErrMessageTagsDisabled {
+				t.Fatalf("Commands.Typing() == %v, want ErrMessageTagsDisabled", err)
+			}
+
+			c.Cmd.ReplyThread(*e, "reply")
+			if got := <-sent; got != "PRIVMSG #channel reply" {
+				t.Fatalf("Commands.ReplyThread() sent %q without message-tags", got)
+			}
+
+			c.Close()
+			server.Close()
+			continue
+		}
+
+		if err := c.Cmd.Typing("#channel", TypingActive); err != nil {
+			t.Fatalf("Commands.Typing() == %v", err)
+		}
+
+		if err := c.Cmd.React("#channel", "abc", "\U0001F44D"); err != nil {
+			t.Fatalf("Commands.React() == %v", err)
+		}
+
+		c.Cmd.ReplyThread(*e, "reply")
+
+		for _, want := range []string{
+			"@+typing=active TAGMSG #channel",
+			"@+draft/react=\U0001F44D;+draft/reply=abc TAGMSG #channel",
+			"@+draft/reply=abc PRIVMSG #channel reply",
+		} {
+			select {
+			case got := <-sent:
+				if got != want {
+					t.Fatalf("server received %q, want %q", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %q", want)
+			}
+		}
+
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestRequestCap(t *testing.T) {
+	ends := make(chan struct{}, 10)
+	c, server := mockRegistered(t, "batch cap-notify draft/multiline=max-bytes=4096", func(e *Event) []string {
+		switch e.Command {
+		case CAP:
+			switch e.Params[0] {
+			case CAP_REQ:
+				if strings.Contains(e.Last(), "bogus") {
+					return []string{":dummy.int CAP test NAK :" + e.Last()}
+				}
+				return []string{":dummy.int CAP test ACK :" + e.Last()}
+			case CAP_END:
+				ends <- struct{}{}
+			}
+		case PING:
+			return []string{
+				":dummy.int CAP test NEW :away-notify example=value",
+				":dummy.int CAP test DEL :batch",
+			}
+		}
+		return nil
+	})
+	defer c.Close()
+	defer server.Close()
+
+	notified := make(chan Event, 10)
+	c.Handlers.Add(CAP_NEW_NOTIFY, func(c *Client, e Event) { notified <- e })
+	c.Handlers.Add(CAP_DEL_NOTIFY, func(c *Client, e Event) { notified <- e })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.RequestCap(ctx, "draft/multiline"); err != nil {
+		t.Fatalf("Client.RequestCap() == %v", err)
+	}
+
+	c.state.RLock()
+	value := c.state.enabledCap["draft/multiline"]["max-bytes"]
+	c.state.RUnlock()
+
+	if !c.HasCapability("draft/multiline") || value != "4096" {
+		t.Fatalf("draft/multiline not enabled with its value after Client.RequestCap(), value == %q", value)
+	}
+
+	err := c.RequestCap(ctx, "draft/multiline", "bogus")
+	if e, ok := err.(ErrCapRejected); !ok || !reflect.DeepEqual(e.Caps, []string{"bogus", "draft/multiline"}) {
+		t.Fatalf("Client.RequestCap() == %v, want ErrCapRejected", err)
+	}
+
+	if err = c.DropCap(ctx, "draft/multiline"); err != nil || c.HasCapability("draft/multiline") {
+		t.Fatalf("Client.DropCap() == %v, or capability still enabled", err)
+	}
+
+	c.Cmd.Ping("caps")
+
+	for _, want := range []string{CAP_NEW_NOTIFY + " away-notify example=value", CAP_DEL_NOTIFY + " batch"} {
+		select {
+		case e := <-notified:
+			if got := e.Command + " " + strings.Join(e.Params, " "); got != want {
+				t.Fatalf("handler received %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("handler didn't receive %q", want)
+		}
+	}
+
+	// away-notify is requested automatically, and batch is gone.
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.HasCapability("away-notify") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !c.HasCapability("away-notify") || c.HasCapability("batch") {
+		t.Fatal("capabilities not updated after CAP NEW and CAP DEL")
+	}
+
+	if len(ends) != 1 {
+		t.Fatalf("CAP END sent %d times, want once", len(ends))
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	// Enough capabilities to exceed the length of a single line.
+	var long []string
+	for i := 0; i < 40; i++ {
+		long = append(long, fmt.Sprintf("x-capability-%03d", i))
+	}
+
+	type advertised struct {
+		value   string
+		request bool
+	}
+
+	hooked := make(map[string]advertised)
+	setup := func(c *Client) {
+		c.Config.SupportedCaps = map[string][]string{"example": {"v2"}}
+		c.Config.HandleCap = func(name, value string, request bool) bool {
+			hooked[name] = advertised{value, request}
+			return request || strings.HasPrefix(name, "x-")
+		}
+	}
+
+	lines := make(chan string, 100)
+	c, server := mockRegistered(t, "", func(e *Event) []string {
+		if e.Command != CAP {
+			return nil
+		}
+
+		lines <- e.Params[0]
+
+		switch e.Params[0] {
+		case CAP_LS:
+			return []string{
+				":dummy.int CAP * LS * :batch example=v1 " + strings.Join(long[:20], " "),
+				":dummy.int CAP * LS :unknown=value " + strings.Join(long[20:], " "),
+			}
+		case CAP_REQ:
+			lines <- e.Last()
+			if strings.Contains(e.Last(), "x-capability-039") {
+				return []string{":dummy.int CAP * NAK :" + e.Last()}
+			}
+		}
+		return nil
+	}, setup)
+	defer c.Close()
+	defer server.Close()
+
+	var reqs []string
+	for len(lines) > 0 {
+		line := <-lines
+		if line == CAP_REQ {
+			reqs = append(reqs, <-lines)
+		} else if line == CAP_END && len(reqs) < 2 {
+			t.Fatal("CAP END sent before all CAP REQ lines were replied to")
+		}
+	}
+
+	if len(reqs) != 2 || len(CAP+" "+CAP_REQ+" :"+reqs[0]) > maxLength {
+		t.Fatalf("CAP REQ lines == %q, want two lines within the length limit", reqs)
+	}
+
+	if strings.Fields(strings.Join(reqs, " "))[0] != "batch" || len(strings.Fields(strings.Join(reqs, " "))) != 41 {
+		t.Fatalf("requested %q, want batch and the x- capabilities", reqs)
+	}
+
+	if got := hooked["example"]; got.value != "v1" || got.request {
+		t.Fatalf("HandleCap(example) called with %#v, want v1 and false", got)
+	}
+
+	if got := hooked["unknown"]; got.value != "value" || got.request {
+		t.Fatalf("HandleCap(unknown) called with %#v, want value and false", got)
+	}
+
+	if !c.HasCapability("x-capability-000") || c.HasCapability("x-capability-039") {
+		t.Fatal("capabilities of the acknowledged and rejected CAP REQ lines not tracked correctly")
+	}
 }
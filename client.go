@@ -31,18 +31,30 @@ type Client struct {
 	Config Config
 	// rx is a buffer of events waiting to be processed.
 	rx chan *Event
-	// tx is a buffer of events waiting to be sent.
-	tx chan *Event
+	// tx is the queue of events waiting to be sent.
+	tx *sendQueue
 	// state represents the throw-away state for the irc session.
 	state *state
 	// initTime represents the creation time of the client.
 	initTime time.Time
-	// Maximum length of an IRC message (excluding the prefix).
+	// Maximum length of an IRC message (excluding the prefix). This should
+	// be guarded with Client.mu, see Client.maxMessageLen().
 	maxMsgLen int
 	// Handlers is a handler which manages internal and external handlers.
 	Handlers *Caller
 	// CTCP is a handler which manages internal and external CTCP handlers.
 	CTCP *CTCP
+	// Batches is a handler which manages handlers for IRCv3 batches.
+	Batches *Batches
+	// StandardReplies is a handler which manages handlers for IRCv3
+	// standard replies (FAIL, WARN and NOTE).
+	StandardReplies *StandardReplies
+	// requests are the requests waiting for their reply. See
+	// Client.Request().
+	requests *pendingRequests
+	// seq hands out the sequence numbers of events. See
+	// Config.SequenceEvents.
+	seq sequencer
 	// Cmd contains various helper methods to interact with the server.
 	Cmd *Commands
 	// mu is the mux used for connections/disconnections from the server,
@@ -59,6 +71,23 @@ type Client struct {
 	conn *ircConn
 	// debug is used if a writer is supplied for Client.Config.Debugger.
 	debug *log.Logger
+	// reconnects is the amount of consecutive reconnection attempts since
+	// the client last successfully registered with the server. This should
+	// be guarded with Client.mu.
+	reconnects int
+	// endpoint is the index of the active endpoint within
+	// Config.endpoints(). This should be guarded with Client.mu.
+	endpoint int
+	// running is closed once Connect() (or any of its variants) returns,
+	// and is nil while it isn't running. This should be guarded with
+	// Client.mu.
+	running chan struct{}
+	// shutdown is true while Client.Shutdown() is in progress. This should
+	// be guarded with Client.mu.
+	shutdown bool
+	// dialing is true while connect() dials the server, which it does
+	// without holding Client.mu. This should be guarded with Client.mu.
+	dialing bool
 }
 
 // Config contains configuration options for an IRC client
@@ -83,9 +112,14 @@ type Config struct {
 	Name string
 	// SASL contains the necessary authentication data to authenticate
 	// with SASL. See the documentation for SASLMech for what is currently
-	// supported. Capability tracking must be enabled for this to work, as
-	// this requires IRCv3 CAP handling.
+	// supported, and SASLMechs for trying multiple mechanisms in order.
+	// Capability tracking must be enabled for this to work, as this
+	// requires IRCv3 CAP handling.
 	SASL SASLMech
+	// SASLOptional, when enabled, continues registration unauthenticated if
+	// SASL authentication fails with all mechanisms, rather than
+	// disconnecting with ErrSASLFailed.
+	SASLOptional bool
 	// WebIRC allows forwarding source user hostname/ip information to the server
 	// (if supported by the server) to ensure the source machine doesn't show as
 	// the source. See the WebIRC type for more information.
@@ -110,13 +144,49 @@ type Config struct {
 	// strict transport policy expires and the first attempt to reconnect back to
 	// the tls version fails.
 	DisableSTSFallback bool
+	// STSStore optionally persists strict transport security policies
+	// provided by servers (e.g. across restarts, see STSFileStore), which
+	// are consulted before connecting. If unset, policies are only kept in
+	// memory for the lifetime of the client.
+	STSStore STSStore
 	// TLSConfig is an optional user-supplied tls configuration, used during
 	// socket creation to the server. SSL must be enabled for this to be used.
 	// This only has an affect during the dial process.
 	TLSConfig *tls.Config
+	// WebSocket, when set, makes the client connect to the server using IRC
+	// over WebSocket (wss:// if SSL is enabled, ws:// otherwise), rather
+	// than a plain TCP connection. See the WebSocket type for more
+	// information. This only has an affect during the dial process. STS
+	// isn't used with WebSocket connections, as the policy applies to the
+	// plain IRC port.
+	WebSocket *WebSocket
+	// Endpoints is an optional ordered list of servers belonging to the same
+	// network. When set, Server, Port, SSL and WebSocket are ignored, and the client
+	// will rotate through the endpoints when it fails to connect to one, or
+	// gets disconnected from one (see Config.Reconnect). Client.Server()
+	// returns the address of the active endpoint. This only has an affect
+	// during the dial process.
+	Endpoints []Endpoint
 	// AllowFlood allows the client to bypass the rate limit of outbound
 	// messages.
 	AllowFlood bool
+	// RateLimiter limits the rate of outbound messages sent with
+	// Client.Send() (and therefore most Commands methods), unless AllowFlood
+	// is enabled. Defaults to a TokenBucket with DefaultBurst and
+	// DefaultRefill. See RateLimiter for more information.
+	RateLimiter RateLimiter
+	// Prioritize optionally returns the priority class of an event sent
+	// with Client.Send(), which determines the order in which queued
+	// events are sent. Defaults to DefaultPriority. See Priority for more
+	// information.
+	Prioritize func(event *Event) Priority
+	// SendQueueSize is the maximum amount of non-critical events (see
+	// Priority) waiting to be sent. Once the queue is full, Client.Send()
+	// blocks until there is room, and Client.SendContext() until there is
+	// room or its context is done. Critical events are never blocked.
+	// Defaults to DefaultSendQueueSize, and a negative value disables the
+	// limit. This only has an effect when passed to New().
+	SendQueueSize int
 	// GlobalFormat enables passing through all events which have trailing
 	// text through the color Fmt() function, so you don't have to wrap
 	// every response in the Fmt() method.
@@ -141,11 +211,27 @@ type Config struct {
 	// DefaultRecoverHandler will log the panic to Debug or os.Stdout if
 	// Debug is unset.
 	RecoverFunc func(c *Client, e *HandlerError)
+	// SequenceEvents enables numbering the events sent to, and received from
+	// each target (channel or user) with a monotonic sequence number (see
+	// Event.Sequence). Unlike Event.Timestamp, which is in server time (see
+	// Client.ServerClockOffset()) and only has millisecond precision, this
+	// always reflects the order in which events have been sent and
+	// received. The numbers of a target don't restart after a reconnect,
+	// but may skip ahead.
+	SequenceEvents bool
+	// EchoMessage enables the echo-message capability, if supported by the
+	// server. The server then sends the messages sent by the client back to
+	// it, which are passed to ALL_EVENTS handlers, as well as handlers for
+	// ECHO_PRIVMSG, ECHO_NOTICE and ECHO_TAGMSG. See Client.SendEcho() for
+	// correlating echoes with the messages sent.
+	EchoMessage bool
 	// SupportedCaps are the IRCv3 capabilities you would like the client to
 	// support on top of the ones which the client already supports (see
 	// cap.go for which ones the client enables by default). Only use this
-	// if you have not called DisableTracking(). The keys value gets passed
-	// to the server if supported.
+	// if you have not called DisableTracking(). If a list of values is
+	// given for a capability, it's only requested if the server advertises
+	// at least one of them (e.g. "sasl": {"PLAIN"} for "sasl=PLAIN,EXTERNAL").
+	// See HandleCap for more control.
 	SupportedCaps map[string][]string
 	// Version is the application version information that will be used in
 	// response to a CTCP VERSION, if default CTCP replies have not been
@@ -158,6 +244,29 @@ type Config struct {
 	// and the client. If this is set to -1, the client will not attempt to
 	// send client -> server PING requests.
 	PingDelay time.Duration
+	// RegisterTimeout is the maximum amount of time the server may take to
+	// accept our registration (including IRCv3 capability negotiation and
+	// SASL authentication) once connected. When exceeded, Connect() returns
+	// ErrCapNegotiation if the client was still negotiating capabilities,
+	// or ErrRegistrationTimeout otherwise. If 0, there is no timeout. Note
+	// that if the server refuses the registration, Connect() returns
+	// ErrBadPassword, ErrBanned, ErrNickUnusable or ErrSASLFailed instead.
+	RegisterTimeout time.Duration
+	// Reconnect, when set, enables automatically reconnecting (with
+	// exponential backoff) when the connection to the server is lost, rather
+	// than returning from Connect(). RECONNECTING is sent before each
+	// attempt, and RECONNECTED once the client has registered with the
+	// server again. See ReconnectPolicy for more information. Connections
+	// made with MockConnect() are never reconnected.
+	Reconnect *ReconnectPolicy
+	// RejoinChannels, when enabled, makes the client remember the channels
+	// it was in (including keys supplied via Commands.JoinKey()) and any away
+	// message set via Commands.Away(), and restore them once registered with
+	// the server after a reconnect. See HandleRejoin to veto or rewrite the
+	// list of channels that will be rejoined. The channels are taken from
+	// channel tracking, so only the away message is restored if
+	// Client.DisableTracking() has been called.
+	RejoinChannels bool
 
 	// disableTracking disables all channel and user-level tracking. Useful
 	// for highly embedded scripts with single purposes. This has an exported
@@ -171,6 +280,18 @@ type Config struct {
 	// blocked by the network/a service, the client will try and use "test_",
 	// then it will attempt "test__", "test___", and so on.
 	HandleNickCollide func(oldNick string) (newNick string)
+	// HandleRejoin when set (and RejoinChannels is enabled), is called with
+	// the channels (mapped to their keys, if any) that are about to be
+	// rejoined after a reconnect. The returned map is joined instead, which
+	// allows the list to be rewritten, or vetoed entirely by returning nil.
+	HandleRejoin func(channels map[string]string) map[string]string
+	// HandleCap when set, is called for each capability advertised by the
+	// server (with CAP LS, and CAP NEW if cap-notify is enabled), with its
+	// value (e.g. "PLAIN,EXTERNAL" for "sasl=PLAIN,EXTERNAL", or empty if it
+	// has none), and whether the client would request it by default (see
+	// SupportedCaps). The capability is requested if it returns true. Note
+	// that the client can only make use of the capabilities it supports.
+	HandleCap func(name, value string, request bool) bool
 }
 
 // WebIRC is useful when a user connects through an indirect method, such web
@@ -206,6 +327,48 @@ func (w WebIRC) Params() []string {
 	return []string{w.Password, w.Gateway, w.Hostname, w.Address}
 }
 
+// Endpoint is a single server which the client may connect to. See
+// Config.Endpoints.
+type Endpoint struct {
+	// Server is a host/ip of the server.
+	Server string
+	// Port is the port of the server. Defaults to 6667.
+	Port int
+	// SSL allows dialing the server via TLS.
+	SSL bool
+	// TLSConfig is an optional tls configuration used for this endpoint. If
+	// unset, Config.TLSConfig is used. SSL must be enabled for this to be
+	// used.
+	TLSConfig *tls.Config
+	// WebSocket, when set, connects to this endpoint using IRC over
+	// WebSocket. See Config.WebSocket.
+	WebSocket *WebSocket
+}
+
+// String returns the host+port pair of the endpoint.
+func (e Endpoint) String() string {
+	port := e.Port
+	if port == 0 {
+		port = 6667
+	}
+
+	return net.JoinHostPort(e.Server, strconv.Itoa(port))
+}
+
+// endpoints returns the list of servers the client should connect to, which
+// is either Config.Endpoints, or the endpoint described by Config.Server,
+// Config.Port, Config.SSL and Config.WebSocket.
+func (conf *Config) endpoints() []Endpoint {
+	if len(conf.Endpoints) > 0 {
+		return conf.Endpoints
+	}
+
+	return []Endpoint{{
+		Server: conf.Server, Port: conf.Port, SSL: conf.SSL,
+		TLSConfig: conf.TLSConfig, WebSocket: conf.WebSocket,
+	}}
+}
+
 // ErrInvalidConfig is returned when the configuration passed to the client
 // is invalid.
 type ErrInvalidConfig struct {
@@ -217,17 +380,30 @@ func (e ErrInvalidConfig) Error() string { return "invalid configuration: " + e.
 
 // isValid checks some basic settings to ensure the config is valid.
 func (conf *Config) isValid() error {
-	if conf.Server == "" {
-		return &ErrInvalidConfig{Conf: *conf, err: errors.New("empty server")}
-	}
+	if len(conf.Endpoints) == 0 {
+		if conf.Server == "" {
+			return &ErrInvalidConfig{Conf: *conf, err: errors.New("empty server")}
+		}
 
-	// Default port to 6667 (the standard IRC port).
-	if conf.Port == 0 {
-		conf.Port = 6667
+		// Default port to 6667 (the standard IRC port).
+		if conf.Port == 0 {
+			conf.Port = 6667
+		}
+
+		if conf.Port < 1 || conf.Port > 65535 {
+			return &ErrInvalidConfig{Conf: *conf, err: errors.New("port outside valid range (1-65535)")}
+		}
 	}
 
-	if conf.Port < 1 || conf.Port > 65535 {
-		return &ErrInvalidConfig{Conf: *conf, err: errors.New("port outside valid range (1-65535)")}
+	for _, endpoint := range conf.Endpoints {
+		if endpoint.Server == "" {
+			return &ErrInvalidConfig{Conf: *conf, err: errors.New("empty server in endpoints")}
+		}
+
+		// Port 0 defaults to 6667, see Endpoint.String().
+		if endpoint.Port < 0 || endpoint.Port > 65535 {
+			return &ErrInvalidConfig{Conf: *conf, err: fmt.Errorf("port of endpoint %s outside valid range (1-65535)", endpoint.Server)}
+		}
 	}
 
 	if !IsValidNick(conf.Nick) {
@@ -244,14 +420,20 @@ func (conf *Config) isValid() error {
 // connected.
 var ErrNotConnected = errors.New("client is not connected to server")
 
+// ErrShuttingDown is returned by Client.SendContext() if the client is
+// shutting down. See Client.Shutdown().
+var ErrShuttingDown = errors.New("client is shutting down")
+
 // New creates a new IRC client with the specified server, name and config.
 func New(config Config) *Client {
 	c := &Client{
-		Config:   config,
-		rx:       make(chan *Event, 25),
-		tx:       make(chan *Event, 25),
-		CTCP:     newCTCP(),
-		initTime: time.Now(),
+		Config:          config,
+		rx:              make(chan *Event, 25),
+		CTCP:            newCTCP(),
+		Batches:         newBatches(),
+		StandardReplies: newStandardReplies(),
+		requests:        newPendingRequests(),
+		initTime:        time.Now(),
 	}
 
 	c.Cmd = &Commands{c: c}
@@ -262,6 +444,15 @@ func New(config Config) *Client {
 		c.Config.PingDelay = 600 * time.Second
 	}
 
+	if c.Config.RateLimiter == nil {
+		c.Config.RateLimiter = &TokenBucket{}
+	}
+
+	if c.Config.SendQueueSize == 0 {
+		c.Config.SendQueueSize = DefaultSendQueueSize
+	}
+	c.tx = newSendQueue(c.Config.SendQueueSize)
+
 	envDebug, _ := strconv.ParseBool(os.Getenv("GIRC_DEBUG"))
 	if c.Config.Debug == nil {
 		if envDebug {
@@ -328,7 +519,12 @@ func (c *Client) TLSConnectionState() (*tls.ConnectionState, error) {
 		return nil, ErrNotConnected
 	}
 
-	if tlsConn, ok := c.conn.sock.(*tls.Conn); ok {
+	sock := c.conn.sock
+	if ws, ok := sock.(*wsConn); ok {
+		sock = ws.Conn
+	}
+
+	if tlsConn, ok := sock.(*tls.Conn); ok {
 		cs := tlsConn.ConnectionState()
 		return &cs, nil
 	}
@@ -361,10 +557,59 @@ func (c *Client) Close() {
 //
 // NOTE: servers may delay showing of QUIT reasons, until you've been connected to
 // the server for a certain period of time (e.g. 5 minutes). Keep this in mind.
+//
+// NOTE: QUIT is a critical event (see DefaultPriority), and is therefore sent
+// ahead of any events which are still waiting in the send queue. Use
+// Client.Shutdown() to send them first.
 func (c *Client) Quit(reason string) {
 	c.Send(&Event{Command: QUIT, Params: []string{reason}})
 }
 
+// Shutdown gracefully disconnects from the server. It stops accepting new
+// events from Client.Send() (Client.SendContext() returns ErrShuttingDown),
+// waits for the events still waiting in the send queue to be sent, sends a
+// QUIT message with the given reason, and waits for the server to close the
+// connection. Shutdown returns once Connect() (or any of its variants) has
+// returned, which doesn't attempt to reconnect.
+//
+// If ctx is done before then, the connection is closed forcefully and the
+// error of ctx is returned, once Connect() has returned. ErrNotConnected is
+// returned if the client isn't connected (or reconnecting).
+func (c *Client) Shutdown(ctx context.Context, reason string) error {
+	c.mu.Lock()
+	running := c.running
+	if running == nil {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	c.shutdown = true
+	connected := c.conn != nil
+	c.mu.Unlock()
+
+	if connected {
+		c.debug.Print("shutting down, waiting for the send queue to drain")
+
+		select {
+		case <-c.tx.drained():
+			c.write(&Event{Command: QUIT, Params: []string{reason}})
+		case <-ctx.Done():
+		}
+	} else {
+		// Cancel the pending reconnect.
+		c.Close()
+	}
+
+	select {
+	case <-running:
+		return nil
+	case <-ctx.Done():
+		c.debug.Printf("shut down timed out, closing connection: %v", ctx.Err())
+		c.Close()
+		<-running
+		return ctx.Err()
+	}
+}
+
 // ErrEvent is an error returned when the server (or library) sends an ERROR
 // message response. The string returned contains the trailing text from the
 // message.
@@ -396,7 +641,7 @@ func (c *Client) execLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 			for {
 				select {
 				case event = <-c.rx:
-					c.RunHandlers(event)
+					c.runEvent(event)
 				default:
 					goto done
 				}
@@ -421,14 +666,16 @@ func (c *Client) execLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 				// actually handle the ERROR event.
 			}
 
-			c.RunHandlers(event)
+			c.runEvent(event)
 		}
 	}
 }
 
 // DisableTracking disables all channel/user-level/CAP tracking, and clears
 // all internal handlers. Useful for highly embedded scripts with single
-// purposes. This cannot be un-done on a client.
+// purposes. This cannot be un-done on a client. As the channels aren't
+// tracked, they aren't rejoined after a reconnect (see
+// Config.RejoinChannels).
 func (c *Client) DisableTracking() {
 	c.debug.Print("disabling tracking")
 	c.Config.disableTracking = true
@@ -442,21 +689,44 @@ func (c *Client) DisableTracking() {
 	c.registerBuiltins()
 }
 
-// Server returns the string representation of host+port pair for the connection.
+// Server returns the string representation of host+port pair for the
+// connection. If Config.Endpoints is used, this is the active endpoint.
 func (c *Client) Server() string {
-	c.state.Lock()
-	defer c.state.Lock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
 	return c.server()
 }
 
 // server returns the string representation of host+port pair for net.Conn, and
-// takes into consideration STS. Must lock state mu first!
+// takes into consideration STS. Must lock Client.mu first!
 func (c *Client) server() string {
+	endpoint := c.activeEndpoint()
+
 	if c.state.sts.enabled() {
-		return net.JoinHostPort(c.Config.Server, strconv.Itoa(c.state.sts.upgradePort))
+		return net.JoinHostPort(endpoint.Server, strconv.Itoa(c.state.sts.upgradePort))
+	}
+	return endpoint.String()
+}
+
+// activeEndpoint returns the endpoint the client is connected to, or will
+// connect to next. Must lock Client.mu first!
+func (c *Client) activeEndpoint() Endpoint {
+	endpoints := c.Config.endpoints()
+	return endpoints[c.endpoint%len(endpoints)]
+}
+
+// rotateEndpoint makes the next endpoint in Config.Endpoints the active
+// one. As strict transport policies apply to a single hostname, the policy
+// is dropped if the hostname changes. Must lock Client.mu first!
+func (c *Client) rotateEndpoint() {
+	prev := c.activeEndpoint()
+	c.endpoint = (c.endpoint + 1) % len(c.Config.endpoints())
+
+	if next := c.activeEndpoint(); next.Server != prev.Server {
+		c.debug.Printf("rotating endpoint from %s to %s", prev, next)
+		c.state.sts.reset()
 	}
-	return net.JoinHostPort(c.Config.Server, strconv.Itoa(c.Config.Port))
 }
 
 // Lifetime returns the amount of time that has passed since the client was
@@ -497,6 +767,12 @@ func (c *Client) ConnSince() (since *time.Duration, err error) {
 	return &timeSince, nil
 }
 
+// SendQueueLen returns the amount of events which are waiting to be sent to
+// the server, including the event being delayed by Config.RateLimiter.
+func (c *Client) SendQueueLen() int {
+	return c.tx.Len()
+}
+
 // IsConnected returns true if the client is connected to the server.
 func (c *Client) IsConnected() bool {
 	c.mu.RLock()
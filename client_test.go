@@ -5,6 +5,9 @@
 package girc
 
 import (
+	"bufio"
+	"context"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -76,6 +79,24 @@ func TestConfigValid(t *testing.T) {
 		t.Fatalf("invalid user passed validation check: %s", err)
 	}
 	conf.User = "test"
+
+	conf.Nick = "test"
+	conf.Server = ""
+	conf.Endpoints = []Endpoint{{Server: "irc1.example.com"}, {Server: "irc2.example.com", Port: 6697, SSL: true}}
+	if err = conf.isValid(); err != nil {
+		t.Fatalf("valid endpoints failed validation check: %s", err)
+	}
+
+	conf.Endpoints[1].Port = 100000
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("invalid endpoint port passed validation check: %s", err)
+	}
+	conf.Endpoints[1].Port = 6697
+
+	conf.Endpoints[0].Server = ""
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("invalid endpoint server passed validation check: %s", err)
+	}
 }
 
 func TestClientLifetime(t *testing.T) {
@@ -198,3 +219,83 @@ func TestClientClose(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestClientShutdown(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.RateLimiter = &TokenBucket{Burst: 1, Refill: 50 * time.Millisecond}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Shutdown(ctx, "bye"); err != ErrNotConnected {
+		t.Fatalf("Client.Shutdown() == %v while disconnected, want ErrNotConnected", err)
+	}
+
+	lines := make(chan string, 10)
+	go func() {
+		b := bufio.NewReader(server)
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(conn) }()
+
+	for line := range lines {
+		if strings.HasPrefix(line, "USER") {
+			break
+		}
+	}
+
+	// These are delayed by the rate limiter, and have to be sent before the
+	// QUIT.
+	for i := 0; i < 3; i++ {
+		c.Cmd.Message("#a", strconv.Itoa(i))
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- c.Shutdown(ctx, "bye") }()
+
+	for i := 0; i < 3; i++ {
+		if line, want := <-lines, "PRIVMSG #a "+strconv.Itoa(i); line != want {
+			t.Fatalf("server received %q, want %q", line, want)
+		}
+	}
+
+	if line := <-lines; line != "QUIT bye" {
+		t.Fatalf("server received %q, want QUIT", line)
+	}
+
+	if err := c.SendContext(ctx, &Event{Command: PRIVMSG, Params: []string{"#a", "late"}}); err != ErrShuttingDown {
+		t.Fatalf("Client.SendContext() == %v while shutting down, want ErrShuttingDown", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Client.Shutdown() == %v before the server closed the connection", err)
+	default:
+	}
+
+	server.Write([]byte("ERROR :Closing link (Quit: bye)\r\n"))
+	server.Close()
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Client.Shutdown() == %v, want nil", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("MockConnect() == %v after shutdown, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("MockConnect() did not return after shutdown")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clockWeight is the weight of a new sample of the server clock offset,
+// compared to the current estimate (i.e. 1/clockWeight).
+const clockWeight = 8
+
+// maxClockJump is the maximum difference between a sample of the server
+// clock offset, taken from an event which isn't a reply to our PING, and the
+// current estimate. Events which differ further are most likely replayed
+// (e.g. by a bouncer), rather than being live.
+const maxClockJump = time.Minute
+
+// serverTime returns the server-time of event, if it has one.
+func serverTime(event *Event) (stime time.Time, ok bool) {
+	raw, ok := event.Tags.Get("time")
+	if !ok {
+		return stime, false
+	}
+
+	stime, err := time.Parse(capServerTimeFormat, raw)
+	return stime, err == nil
+}
+
+// sampleClock updates the estimate of the server clock offset with a new
+// sample. Exact samples (see observePong) re-seed the estimate if it's too
+// far off. Other samples are ignored in that case, and only seed the
+// estimate if seed is true.
+func (c *Client) sampleClock(offset time.Duration, exact, seed bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.conn == nil {
+		return
+	}
+
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+
+	if c.conn.clockSamples == 0 && !exact && !seed {
+		return
+	}
+
+	diff := offset - c.conn.clockOffset
+	jumped := diff > maxClockJump || diff < -maxClockJump
+	if !exact && jumped && c.conn.clockSamples > 0 {
+		return
+	}
+
+	if c.conn.clockSamples == 0 || jumped {
+		c.conn.clockOffset = offset
+		c.conn.clockSamples = 1
+		return
+	}
+
+	c.conn.clockOffset += diff / clockWeight
+	c.conn.clockSamples++
+}
+
+// observeClock samples the server clock offset from an event received at
+// the given (local) time, if it was stamped with server-time. Events within
+// batches are ignored, as they may be replayed. Any event received after
+// registration may be replayed as well (e.g. by a bouncer), so only
+// RPL_WELCOME seeds the estimate.
+func (c *Client) observeClock(event *Event, received time.Time) {
+	if _, ok := batchRef(event); ok {
+		return
+	}
+
+	stime, ok := serverTime(event)
+	if !ok {
+		return
+	}
+
+	// The server stamped the event about half a round-trip before we
+	// received it.
+	c.sampleClock(stime.Sub(received)+c.Latency()/2, false, event.Command == RPL_WELCOME)
+}
+
+// observePong samples the server clock offset from the reply to a PING sent
+// by pingLoop, which contains the time the PING was sent, if the reply was
+// stamped with server-time.
+func (c *Client) observePong(event *Event, received time.Time) {
+	stime, ok := serverTime(event)
+	if !ok {
+		return
+	}
+
+	nano, err := strconv.ParseInt(event.Last(), 10, 64)
+	if err != nil {
+		return
+	}
+
+	// Ignore replies to PINGs which weren't sent by pingLoop.
+	sent := time.Unix(0, nano)
+	if sent.After(received) || received.Sub(sent) > time.Minute {
+		return
+	}
+
+	// The server stamped the reply about half-way through the round-trip.
+	c.sampleClock(stime.Sub(sent.Add(received.Sub(sent)/2)), true, true)
+}
+
+// ServerClockOffset returns the estimated offset of the server clock to the
+// local clock (i.e. the server time is the local time plus the offset). The
+// estimate is based on the server-time of the events received from the
+// server, and the replies to the PINGs the client sends (see
+// Config.PingDelay), and therefore requires the server-time capability. The
+// offset is 0 if it's unknown, or if the client is disconnected.
+func (c *Client) ServerClockOffset() (offset time.Duration) {
+	c.mu.RLock()
+	if c.conn != nil {
+		c.conn.mu.RLock()
+		offset = c.conn.clockOffset
+		c.conn.mu.RUnlock()
+	}
+	c.mu.RUnlock()
+
+	return offset
+}
+
+// maxSequenceTargets is the maximum number of targets the sequencer keeps
+// track of, before it's reset.
+const maxSequenceTargets = 4096
+
+// sequencer hands out monotonic sequence numbers per target. See
+// Config.SequenceEvents. It is safe for concurrent use.
+type sequencer struct {
+	mu   sync.Mutex
+	last map[string]uint64
+	// floor is the highest sequence number handed out before the last
+	// reset. Targets which aren't tracked continue from there.
+	floor uint64
+}
+
+// next returns the next sequence number for target.
+func (s *sequencer) next(target string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.last[target]
+	if !ok {
+		if len(s.last) >= maxSequenceTargets {
+			s.resetLocked()
+		}
+
+		if s.last == nil {
+			s.last = make(map[string]uint64)
+		}
+		last = s.floor
+	}
+
+	s.last[target] = last + 1
+	return last + 1
+}
+
+// reset forgets the targets, without breaking the monotonicity of the
+// sequence numbers handed out for them.
+func (s *sequencer) reset() {
+	s.mu.Lock()
+	s.resetLocked()
+	s.mu.Unlock()
+}
+
+// resetLocked is like reset, but expects s.mu to be held.
+func (s *sequencer) resetLocked() {
+	for _, last := range s.last {
+		if last > s.floor {
+			s.floor = last
+		}
+	}
+
+	s.last = nil
+}
+
+// sequenceTarget returns the target an event is sequenced by, or an empty
+// string if it has none. For private messages received from other users,
+// this is the user who sent it.
+func sequenceTarget(event *Event, outgoing bool) string {
+	if len(event.Params) == 0 {
+		return ""
+	}
+
+	target := event.Params[0]
+
+	switch event.Command {
+	case PRIVMSG, NOTICE, CAP_TAGMSG:
+		if !outgoing && !event.Echo && !IsValidChannel(target) {
+			if event.Source == nil {
+				return ""
+			}
+			target = event.Source.Name
+		}
+	case JOIN, PART, KICK, TOPIC, MODE:
+		if !IsValidChannel(target) {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	return ToRFC1459(target)
+}
+
+// sequence sets the sequence number of event, if enabled.
+func (c *Client) sequence(event *Event, outgoing bool) {
+	if !c.Config.SequenceEvents {
+		return
+	}
+
+	if target := sequenceTarget(event, outgoing); target != "" {
+		event.Sequence = c.seq.next(target)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerClockOffset(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.SequenceEvents = true
+	defer c.Close()
+	defer server.Close()
+
+	const skew = 10 * time.Second
+	stamp := func() string {
+		return "@time=" + time.Now().Add(skew).UTC().Format(capServerTimeFormat) + " "
+	}
+
+	go mockServer(server, func(e *Event) []string {
+		switch e.Command {
+		case USER:
+			return []string{stamp() + ":dummy.int 001 test :Welcome"}
+		case PING:
+			return []string{stamp() + ":dummy.int PONG dummy.int :" + e.Last()}
+		case PRIVMSG:
+			return []string{
+				stamp() + ":nick!user@host PRIVMSG #channel :reply",
+				stamp() + ":nick!user@host PRIVMSG test :private",
+			}
+		}
+		return nil
+	})
+
+	messages := make(chan Event, 10)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { messages <- e })
+
+	registered := make(chan struct{})
+	c.Handlers.Add(RPL_WELCOME, func(c *Client, e Event) { close(registered) })
+	go c.MockConnect(conn)
+	<-registered
+
+	c.Cmd.Ping(strconv.FormatInt(time.Now().UnixNano(), 10))
+	sent := c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "test"}})
+
+	var got []Event
+	for len(got) < 2 {
+		select {
+		case e := <-messages:
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+
+	if offset := c.ServerClockOffset(); offset < skew-time.Second || offset > skew+time.Second {
+		t.Fatalf("Client.ServerClockOffset() == %s, want ~%s", offset, skew)
+	}
+
+	// The message was sent before the offset was known, but the next one
+	// should be stamped in server time, once written.
+	sent = c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "test"}})
+	<-c.tx.drained()
+	if diff := sent[0].Timestamp.Sub(time.Now()); diff < skew-time.Second || diff > skew+time.Second {
+		t.Fatalf("sent event stamped %s off local time, want ~%s", diff, skew)
+	}
+
+	if sent[0].Sequence != 3 || got[0].Sequence != 2 || got[1].Sequence != 1 {
+		t.Fatalf("sequence numbers == %d, %d, %d, want 3, 2, 1", sent[0].Sequence, got[0].Sequence, got[1].Sequence)
+	}
+}
+
+// delayLimiter delays each event by the same duration.
+type delayLimiter time.Duration
+
+func (d delayLimiter) Delay(length int) time.Duration { return time.Duration(d) }
+
+func TestSequenceWriteOrder(t *testing.T) {
+	written := make(chan string, 10)
+	c, server := mockRegistered(t, "", func(e *Event) []string {
+		if e.Command == PRIVMSG || e.Command == MODE {
+			written <- e.String()
+		}
+		return nil
+	}, func(c *Client) {
+		c.Config.SequenceEvents = true
+		c.Config.RateLimiter = delayLimiter(100 * time.Millisecond)
+	})
+	defer c.Close()
+	defer server.Close()
+
+	// The mode query is bulk, so it's sent after the message queued after
+	// it, and has to be numbered accordingly.
+	c.Cmd.Message("#other", "delayed")
+	mode := c.Send(&Event{Command: MODE, Params: []string{"#channel"}})
+	message := c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "test"}})
+	<-c.tx.drained()
+
+	for _, want := range []string{"PRIVMSG #other delayed", "PRIVMSG #channel test", "MODE #channel"} {
+		select {
+		case got := <-written:
+			if got != want {
+				t.Fatalf("server received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	if message[0].Sequence != 1 || mode[0].Sequence != 2 {
+		t.Fatalf("sequence numbers == %d, %d, want 1, 2", message[0].Sequence, mode[0].Sequence)
+	}
+
+	if message[0].Timestamp.After(mode[0].Timestamp) {
+		t.Fatalf("message stamped %s, after the mode query stamped %s", message[0].Timestamp, mode[0].Timestamp)
+	}
+}
+
+func TestSequenceTarget(t *testing.T) {
+	tests := []struct {
+		raw      string
+		outgoing bool
+		want     string
+	}{
+		{":nick!user@host PRIVMSG #Channel :test", false, "#channel"},
+		{":nick!user@host PRIVMSG test :test", false, "nick"},
+		{"PRIVMSG Nick :test", true, "nick"},
+		{":nick!user@host JOIN #channel", false, "#channel"},
+		{":nick!user@host MODE test +i", false, ""},
+		{"PING :token", true, ""},
+	}
+
+	for _, tt := range tests {
+		if got := sequenceTarget(ParseEvent(tt.raw), tt.outgoing); got != tt.want {
+			t.Errorf("sequenceTarget(%q) == %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestObserveClock(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.conn = &ircConn{registered: make(chan struct{})}
+
+	now := time.Now()
+	at := func(raw string, offset time.Duration) *Event {
+		return ParseEvent("@time=" + now.Add(offset).UTC().Format(capServerTimeFormat) + " " + raw)
+	}
+
+	// A replayed message doesn't seed the estimate, but the welcome does.
+	c.observeClock(at(":nick!user@host PRIVMSG #channel :old", -time.Hour), now)
+	if offset := c.ServerClockOffset(); offset != 0 {
+		t.Fatalf("Client.ServerClockOffset() == %s after replayed message, want 0", offset)
+	}
+
+	c.observeClock(at(":dummy.int 001 test :Welcome", time.Hour), now)
+	if offset := c.ServerClockOffset(); offset < time.Hour-time.Second || offset > time.Hour+time.Second {
+		t.Fatalf("Client.ServerClockOffset() == %s, want ~1h", offset)
+	}
+
+	// Replies to our PINGs re-seed the estimate if it's far off.
+	pong := at(":dummy.int PONG dummy.int :"+strconv.FormatInt(now.UnixNano(), 10), 0)
+	c.observePong(pong, now)
+	if offset := c.ServerClockOffset(); offset < -time.Second || offset > time.Second {
+		t.Fatalf("Client.ServerClockOffset() == %s after PONG, want ~0", offset)
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	var s sequencer
+	s.next("#a")
+	s.next("#a")
+
+	if got := s.next("#b"); got != 1 {
+		t.Fatalf("sequencer.next(#b) == %d, want 1", got)
+	}
+
+	// The numbers continue after a reset, rather than restarting.
+	s.reset()
+	if got := s.next("#b"); got != 3 {
+		t.Fatalf("sequencer.next(#b) == %d after reset, want 3", got)
+	}
+
+	for i := 0; i < maxSequenceTargets+1; i++ {
+		s.next(strconv.Itoa(i))
+	}
+
+	if len(s.last) > maxSequenceTargets {
+		t.Fatalf("sequencer tracks %d targets, want at most %d", len(s.last), maxSequenceTargets)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"errors"
 	"fmt"
+	"time"
 )
 
 // Commands holds a large list of useful methods to interact with the server,
@@ -31,10 +32,9 @@ func (cmd *Commands) Join(channels ...string) {
 	var buffer string
 
 	for i := 0; i < len(channels); i++ {
-		if len(buffer+","+channels[i]) > max {
+		if len(buffer) > 0 && len(buffer+","+channels[i]) > max {
 			cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
 			buffer = ""
-			continue
 		}
 
 		if len(buffer) == 0 {
@@ -42,16 +42,24 @@ func (cmd *Commands) Join(channels ...string) {
 		} else {
 			buffer += "," + channels[i]
 		}
+	}
 
-		if i == len(channels)-1 {
-			cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
-			return
-		}
+	if len(buffer) > 0 {
+		cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
 	}
 }
 
 // JoinKey attempts to enter an IRC channel with a password.
 func (cmd *Commands) JoinKey(channel, password string) {
+	// Remember the key, so the channel can be rejoined after a reconnect.
+	// Without tracking, channels are never rejoined (nor their keys
+	// forgotten), so there's no need to.
+	if !cmd.c.Config.disableTracking {
+		cmd.c.state.Lock()
+		cmd.c.state.keys[ToRFC1459(channel)] = password
+		cmd.c.state.Unlock()
+	}
+
 	cmd.c.Send(&Event{Command: JOIN, Params: []string{channel, password}})
 }
 
@@ -168,6 +176,41 @@ func (cmd *Commands) ReplyTof(event Event, format string, a ...interface{}) {
 	cmd.ReplyTo(event, fmt.Sprintf(format, a...))
 }
 
+// MessageReply sends a PRIVMSG to target (either channel, service, or user)
+// as a reply to the message with the given msgid (see Event.MsgID()). The
+// reply is sent as a regular message if the message-tags capability isn't
+// enabled, or msgid is empty.
+func (cmd *Commands) MessageReply(target, msgid, message string) {
+	event := &Event{Command: PRIVMSG, Params: []string{target, message}}
+	if msgid != "" {
+		event.Tags = Tags{}
+		if err := event.Tags.Set(TagReply, msgid); err != nil {
+			event.Tags = nil
+		}
+	}
+
+	cmd.c.Send(event)
+}
+
+// ReplyThread is like Commands.Reply(), but marks the message as a reply to
+// the event (see Commands.MessageReply()), so clients supporting it can
+// display it as such.
+//
+// Panics if nil source.
+func (cmd *Commands) ReplyThread(event Event, message string) {
+	if event.Source == nil {
+		panic(ErrInvalidSource)
+	}
+
+	target := event.Source.Name
+	if len(event.Params) > 0 && IsValidChannel(event.Params[0]) {
+		target = event.Params[0]
+	}
+
+	msgid, _ := event.MsgID()
+	cmd.MessageReply(target, msgid, message)
+}
+
 // Action sends a PRIVMSG ACTION (/me) to target (either channel, service,
 // or user).
 func (cmd *Commands) Action(target, message string) {
@@ -194,6 +237,51 @@ func (cmd *Commands) Noticef(target, format string, a ...interface{}) {
 	cmd.Notice(target, fmt.Sprintf(format, a...))
 }
 
+// TagMsg sends a TAGMSG to target (either channel, service, or user), a
+// message without text which only carries tags, usually client-only tags
+// (prefixed with "+"). See Commands.Typing() and Commands.React() for common
+// uses. ErrMessageTagsDisabled is returned if the message-tags capability
+// isn't enabled, as the message would be empty otherwise.
+func (cmd *Commands) TagMsg(target string, tags Tags) error {
+	if !cmd.c.capEnabled("message-tags") {
+		return ErrMessageTagsDisabled
+	}
+
+	event := &Event{Tags: Tags{}, Command: CAP_TAGMSG, Params: []string{target}}
+	for key := range tags {
+		value, _ := tags.Get(key)
+		if err := event.Tags.Set(key, value); err != nil {
+			return err
+		}
+	}
+
+	cmd.c.Send(event)
+	return nil
+}
+
+// Typing sends a typing notification to target, with the given state:
+// TypingActive while the user is typing (at most every 3 seconds),
+// TypingPaused if they stopped typing, and TypingDone if they cleared their
+// input without sending a message. See Commands.TagMsg() for errors.
+func (cmd *Commands) Typing(target, state string) error {
+	return cmd.TagMsg(target, Tags{TagTyping: state})
+}
+
+// React sends a reaction (e.g. an emoji) to the message with the given msgid
+// (see Event.MsgID()) to target. See Commands.TagMsg() for errors.
+func (cmd *Commands) React(target, msgid, reaction string) error {
+	tags := Tags{}
+	if err := tags.Set(TagReply, msgid); err != nil {
+		return err
+	}
+
+	if err := tags.Set(TagReact, reaction); err != nil {
+		return err
+	}
+
+	return cmd.TagMsg(target, tags)
+}
+
 // SendRaw sends a raw string (or multiple) to the server, without carriage
 // returns or newlines. Returns an error if one of the raw strings cannot be
 // properly parsed.
@@ -309,12 +397,20 @@ func (cmd *Commands) Away(reason string) {
 		return
 	}
 
+	cmd.c.state.Lock()
+	cmd.c.state.away = reason
+	cmd.c.state.Unlock()
+
 	cmd.c.Send(&Event{Command: AWAY, Params: []string{reason}})
 }
 
 // Back sends a AWAY query to the server, however the query is blank,
 // suggesting that the client is active once again. Also see Client.Away().
 func (cmd *Commands) Back() {
+	cmd.c.state.Lock()
+	cmd.c.state.away = ""
+	cmd.c.state.Unlock()
+
 	cmd.c.Send(&Event{Command: AWAY})
 }
 
@@ -365,3 +461,55 @@ func (cmd *Commands) Whowas(user string, amount int) {
 func (cmd *Commands) Monitor(modifier rune, args ...string) {
 	cmd.c.Send(&Event{Command: MONITOR, Params: append([]string{string(modifier)}, args...)})
 }
+
+// history sends a CHATHISTORY request for target. See Client.History() for
+// a way to wait for the reply.
+func (cmd *Commands) history(target string, query HistoryQuery) {
+	cmd.c.Send(&Event{Command: CHATHISTORY, Params: query.params(target, cmd.c.historyLimit(query.Limit))})
+}
+
+// HistoryLatest requests the latest messages of target with CHATHISTORY
+// LATEST, but only those after the given anchor, if it's not empty. If limit
+// is 0, the maximum the server allows is requested. Requires the
+// draft/chathistory capability, see https://ircv3.net/specs/extensions/chathistory
+func (cmd *Commands) HistoryLatest(target string, after HistoryAnchor, limit int) {
+	cmd.history(target, HistoryQuery{Type: CHATHISTORY_LATEST, Anchor: after, Limit: limit})
+}
+
+// HistoryBefore requests the messages of target before the given anchor with
+// CHATHISTORY BEFORE. See Commands.HistoryLatest() for more information.
+func (cmd *Commands) HistoryBefore(target string, anchor HistoryAnchor, limit int) {
+	cmd.history(target, HistoryQuery{Type: CHATHISTORY_BEFORE, Anchor: anchor, Limit: limit})
+}
+
+// HistoryAfter requests the messages of target after the given anchor with
+// CHATHISTORY AFTER. See Commands.HistoryLatest() for more information.
+func (cmd *Commands) HistoryAfter(target string, anchor HistoryAnchor, limit int) {
+	cmd.history(target, HistoryQuery{Type: CHATHISTORY_AFTER, Anchor: anchor, Limit: limit})
+}
+
+// HistoryAround requests the messages of target around the given anchor with
+// CHATHISTORY AROUND. See Commands.HistoryLatest() for more information.
+func (cmd *Commands) HistoryAround(target string, anchor HistoryAnchor, limit int) {
+	cmd.history(target, HistoryQuery{Type: CHATHISTORY_AROUND, Anchor: anchor, Limit: limit})
+}
+
+// HistoryBetween requests the messages of target between the given anchors
+// with CHATHISTORY BETWEEN. See Commands.HistoryLatest() for more
+// information.
+func (cmd *Commands) HistoryBetween(target string, start, end HistoryAnchor, limit int) {
+	cmd.history(target, HistoryQuery{Type: CHATHISTORY_BETWEEN, Anchor: start, End: end, Limit: limit})
+}
+
+// HistoryTargets requests the targets (channels and nicks) with messages
+// between the given times with CHATHISTORY TARGETS. The server replies with
+// a draft/chathistory-targets batch. See Commands.HistoryLatest() for more
+// information.
+func (cmd *Commands) HistoryTargets(start, end time.Time, limit int) {
+	cmd.c.Send(&Event{Command: CHATHISTORY, Params: []string{
+		CHATHISTORY_TARGETS,
+		HistoryTime(start).String(),
+		HistoryTime(end).String(),
+		strconv.Itoa(cmd.c.historyLimit(limit)),
+	}})
+}
@@ -9,7 +9,9 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -32,9 +34,6 @@ type ircConn struct {
 	// lastActive is the last time the client was interacting with the server,
 	// excluding a few background commands (PING, PONG, WHO, etc).
 	lastActive time.Time
-	// writeDelay is used to keep track of rate limiting of events sent to
-	// the server.
-	writeDelay time.Duration
 	// connected is true if we're actively connected to a server.
 	connected bool
 	// connTime is the time at which the client has connected to a server.
@@ -45,6 +44,36 @@ type ircConn struct {
 	// received a successful pong back.
 	lastPong  time.Time
 	pingDelay time.Duration
+	// registered is closed once the server has accepted our registration.
+	registered chan struct{}
+	// capPending is true while we're negotiating capabilities with the
+	// server, before we have sent CAP END.
+	capPending bool
+	// regErr is the reason why the server refused our registration, if any.
+	regErr error
+	// clockOffset is the estimated offset of the server clock, based on
+	// clockSamples samples. See Client.ServerClockOffset().
+	clockOffset  time.Duration
+	clockSamples int
+}
+
+// isRegistered returns true if the server has accepted our registration.
+func (c *ircConn) isRegistered() bool {
+	select {
+	case <-c.registered:
+		return true
+	default:
+		return false
+	}
+}
+
+// markRegistered marks the registration as accepted by the server.
+func (c *ircConn) markRegistered() {
+	c.mu.Lock()
+	if !c.isRegistered() {
+		close(c.registered)
+	}
+	c.mu.Unlock()
 }
 
 // Dialer is an interface implementation of net.Dialer. Use this if you would
@@ -57,17 +86,111 @@ type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
 
-// newConn sets up and returns a new connection to the server.
-func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ircConn, error) {
-	if err := conf.isValid(); err != nil {
-		return nil, err
+// ContextDialer is an optional interface which a Dialer can implement, to
+// allow the dial process to be cancelled or timed out using the context
+// supplied to Client.ConnectContext() or Client.DialerConnectContext().
+// net.Dialer implements this interface.
+type ContextDialer interface {
+	// DialContext is the same as Dialer.Dial, however the dial should be
+	// aborted once ctx is done.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// defaultDialTimeout is the timeout used to dial each endpoint (including
+// the TLS handshake), or the deadline of the context supplied to the
+// client, if that's sooner.
+const defaultDialTimeout = 5 * time.Second
+
+// ReconnectPolicy configures if and how the client automatically reconnects
+// to the server when the connection is lost. See Config.Reconnect.
+type ReconnectPolicy struct {
+	// MaxAttempts is the maximum amount of consecutive reconnection attempts
+	// before giving up, in which case Connect() returns the last error. The
+	// counter is reset once the client has successfully registered with the
+	// server again. If 0, the client will attempt to reconnect indefinitely.
+	MaxAttempts int
+	// BaseDelay is the delay before the first reconnection attempt, which is
+	// doubled for each following consecutive attempt. Defaults to 5 seconds.
+	BaseDelay time.Duration
+	// MaxDelay is the upper limit of the delay between reconnection attempts.
+	// Defaults to 5 minutes.
+	MaxDelay time.Duration
+	// Jitter is the fraction (between 0 and 1) of each delay which is
+	// randomized, to prevent many clients from reconnecting in lockstep (e.g.
+	// after a netsplit). For example, a jitter of 0.2 with a delay of 10
+	// seconds results in a delay between 8 and 10 seconds.
+	Jitter float64
+	// Retryable optionally reports if the client should attempt to reconnect
+	// after the connection failed with the given error. If unset,
+	// DefaultRetryable is used.
+	Retryable func(err error) bool
+}
+
+// delay returns the amount of time to wait before the given (1-indexed)
+// reconnection attempt.
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	delay, max := p.BaseDelay, p.MaxDelay
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// retryable reports if the client should reconnect after err.
+func (p *ReconnectPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
 	}
 
+	return DefaultRetryable(err)
+}
+
+// DefaultRetryable is the default ReconnectPolicy.Retryable function. It
+// considers all errors retryable, except for those which would fail again
+// without user intervention (e.g. an invalid configuration, or the server
+// rejecting our password).
+func DefaultRetryable(err error) bool {
+	switch err.(type) {
+	case ErrInvalidConfig, *ErrInvalidConfig:
+		return false
+	case ErrBadPassword, *ErrBadPassword, ErrBanned, *ErrBanned:
+		return false
+	case ErrNickUnusable, *ErrNickUnusable, ErrSASLFailed, *ErrSASLFailed:
+		return false
+	}
+
+	return true
+}
+
+// newConn sets up and returns a new connection to the given endpoint. Dialing
+// is aborted once ctx is done, if the dialer supports it (see ContextDialer).
+func newConn(ctx context.Context, conf Config, endpoint Endpoint, dialer Dialer, addr string, sts *strictTransport) (*ircConn, error) {
 	var conn net.Conn
 	var err error
 
 	if dialer == nil {
-		netDialer := &net.Dialer{Timeout: 5 * time.Second}
+		netDialer := &net.Dialer{}
 
 		if conf.Bind != "" {
 			var local *net.TCPAddr
@@ -82,7 +205,18 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 		dialer = netDialer
 	}
 
-	if conn, err = dialer.Dial("tcp", addr); err != nil {
+	// Always bound each attempt, so a single unreachable endpoint doesn't
+	// use up the deadline of the whole connection.
+	ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+	defer cancel()
+
+	if ctxDialer, ok := dialer.(ContextDialer); ok {
+		conn, err = ctxDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
 		if sts.enabled() {
 			err = &ErrSTSUpgradeFailed{Err: err}
 		}
@@ -94,10 +228,17 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 		return nil, err
 	}
 
-	if conf.SSL || sts.enabled() {
+	if endpoint.SSL || sts.enabled() {
+		tlsConfig := endpoint.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = conf.TLSConfig
+		}
+
 		var tlsConn net.Conn
-		tlsConn, err = tlsHandshake(conn, conf.TLSConfig, conf.Server, true)
+		tlsConn, err = tlsHandshake(ctx, conn, tlsConfig, endpoint.Server, true)
 		if err != nil {
+			conn.Close()
+
 			if sts.enabled() {
 				err = &ErrSTSUpgradeFailed{Err: err}
 			}
@@ -112,12 +253,29 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 		conn = tlsConn
 	}
 
+	if endpoint.WebSocket != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		var ws *wsConn
+		ws, err = newWebSocketConn(conn, addr, endpoint.SSL || sts.enabled(), endpoint.WebSocket)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		_ = conn.SetDeadline(time.Time{})
+		conn = ws
+	}
+
 	ctime := time.Now()
 
 	c := &ircConn{
-		sock:      conn,
-		connTime:  &ctime,
-		connected: true,
+		sock:       conn,
+		connTime:   &ctime,
+		connected:  true,
+		registered: make(chan struct{}),
 	}
 	c.newReadWriter()
 
@@ -127,15 +285,30 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 func newMockConn(conn net.Conn) *ircConn {
 	ctime := time.Now()
 	c := &ircConn{
-		sock:      conn,
-		connTime:  &ctime,
-		connected: true,
+		sock:       conn,
+		connTime:   &ctime,
+		connected:  true,
+		registered: make(chan struct{}),
 	}
 	c.newReadWriter()
 
 	return c
 }
 
+// ErrContextDone is returned when the context supplied to the client (e.g.
+// with Client.ConnectContext()) is done, and the client disconnected because
+// of it. Err is the error returned by the contexts Err() method.
+type ErrContextDone struct {
+	Err error
+}
+
+func (e ErrContextDone) Error() string { return "connection closed: " + e.Err.Error() }
+
+// Unwrap returns the error of the context, so errors.Is(err,
+// context.Canceled) and errors.Is(err, context.DeadlineExceeded) work as
+// expected.
+func (e ErrContextDone) Unwrap() error { return e.Err }
+
 // ErrParseEvent is returned when an event cannot be parsed with ParseEvent().
 type ErrParseEvent struct {
 	Line string
@@ -171,12 +344,24 @@ func (c *ircConn) newReadWriter() {
 	c.io = bufio.NewReadWriter(bufio.NewReader(c.sock), bufio.NewWriter(c.sock))
 }
 
-func tlsHandshake(conn net.Conn, conf *tls.Config, server string, validate bool) (net.Conn, error) {
+// tlsHandshake performs the TLS handshake on conn, which is aborted once ctx
+// is done.
+func tlsHandshake(ctx context.Context, conn net.Conn, conf *tls.Config, server string, validate bool) (net.Conn, error) {
 	if conf == nil {
 		conf = &tls.Config{ServerName: server, InsecureSkipVerify: !validate}
+	} else if conf.ServerName == "" {
+		// As the connection may have been made through a proxy (or
+		// otherwise doesn't know the hostname), verify the certificate
+		// against the server we wanted to connect to.
+		conf = conf.Clone()
+		conf.ServerName = server
 	}
 
 	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
 	return net.Conn(tlsConn), nil
 }
 
@@ -195,22 +380,44 @@ func (c *ircConn) Close() error {
 //
 // If this returns nil, this means that the client requested to be closed
 // (e.g. Client.Close()). Connect will panic if called when the last call has
-// not completed.
+// not completed. See ConnectContext() to control the connection with a
+// context.
 func (c *Client) Connect() error {
-	return c.internalConnect(nil, nil)
+	return c.internalConnect(context.Background(), nil, nil)
+}
+
+// ConnectContext is the same as Connect(), however the dial process, the
+// registration with the server and the connection as a whole are bound to
+// ctx. Once ctx is done, the client disconnects from the server (without
+// sending a QUIT) and returns an error which wraps ctx.Err(). Dialing each
+// endpoint (including the TLS handshake) times out after 5 seconds, or once
+// ctx is done, if that's sooner.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	return c.internalConnect(ctx, nil, nil)
 }
 
 // DialerConnect allows you to specify your own custom dialer which implements
-// the Dialer interface.
+// the Dialer interface. TLS (see Config.SSL) and strict transport security
+// upgrades are negotiated on top of the connection returned by the dialer.
 //
-// An example of using this library would be to take advantage of the
-// golang.org/x/net/proxy library:
+// The github.com/lrstanley/girc/proxy package provides SOCKS5 and HTTP
+// CONNECT proxy dialers:
 //
-//	proxyUrl, _ := proxyURI, err = url.Parse("socks5://1.2.3.4:8888")
-//	dialer, _ := proxy.FromURL(proxyURI, &net.Dialer{Timeout: 5 * time.Second})
-//	_ := girc.DialerConnect(dialer)
+//	dialer, err := proxy.FromURL("socks5://1.2.3.4:8888", nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	err = client.DialerConnect(dialer)
 func (c *Client) DialerConnect(dialer Dialer) error {
-	return c.internalConnect(nil, dialer)
+	return c.internalConnect(context.Background(), nil, dialer)
+}
+
+// DialerConnectContext is the same as DialerConnect(), however the
+// connection is bound to ctx, see ConnectContext(). ctx is only passed on
+// to the dialer if it implements ContextDialer.
+func (c *Client) DialerConnectContext(ctx context.Context, dialer Dialer) error {
+	return c.internalConnect(ctx, nil, dialer)
 }
 
 // MockConnect is used to implement mocking with an IRC server. Supply a net.Conn
@@ -257,55 +464,210 @@ func (c *Client) DialerConnect(dialer Dialer) error {
 //	 	// Do stuff with event here.
 //	 }
 func (c *Client) MockConnect(conn net.Conn) error {
-	return c.internalConnect(conn, nil)
+	return c.internalConnect(context.Background(), conn, nil)
+}
+
+// MockConnectContext is the same as MockConnect(), however the connection
+// is bound to ctx, see ConnectContext().
+func (c *Client) MockConnectContext(ctx context.Context, conn net.Conn) error {
+	return c.internalConnect(ctx, conn, nil)
+}
+
+func (c *Client) internalConnect(parent context.Context, mock net.Conn, dialer Dialer) error {
+	done := make(chan struct{})
+
+	c.mu.Lock()
+	c.running = done
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.reconnects = 0
+		c.running = nil
+		c.shutdown = false
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	for {
+		err := c.connect(parent, mock, dialer)
+
+		// The server closing the connection is expected when shutting down.
+		if _, ok := err.(*ErrContextDone); !ok && c.shuttingDown() {
+			c.debug.Printf("shut down: %v", err)
+			return nil
+		}
+
+		// Mocked connections cannot be re-dialed.
+		if err == nil || mock != nil || c.Config.Reconnect == nil || parent.Err() != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.reconnects++
+		attempt := c.reconnects
+		c.mu.Unlock()
+
+		policy := c.Config.Reconnect
+		if !policy.retryable(err) {
+			c.debug.Printf("not reconnecting, error is not retryable: %v", err)
+			return err
+		}
+
+		if policy.MaxAttempts > 0 && attempt > policy.MaxAttempts {
+			c.debug.Printf("not reconnecting, exceeded max attempts (%d): %v", policy.MaxAttempts, err)
+			return err
+		}
+
+		delay := policy.delay(attempt)
+
+		c.mu.RLock()
+		addr := c.server()
+		c.mu.RUnlock()
+
+		c.debug.Printf("reconnecting to %s in %s (attempt %d): %v", addr, delay, attempt, err)
+		c.RunHandlers(&Event{Command: RECONNECTING, Params: []string{strconv.Itoa(attempt), addr}})
+
+		// Allow Close() to interrupt the delay.
+		c.mu.Lock()
+		ctx, stop := context.WithCancel(parent)
+		c.stop = stop
+		c.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if err = parent.Err(); err != nil {
+				c.debug.Printf("context done, cancelling reconnect: %v", err)
+				return &ErrContextDone{Err: err}
+			}
+
+			c.debug.Print("received request to close, cancelling reconnect")
+			return nil
+		case <-timer.C:
+			stop()
+		}
+	}
 }
 
-func (c *Client) internalConnect(mock net.Conn, dialer Dialer) error {
+// dial tries to connect to each endpoint once, starting with the active one,
+// and returns the connection and address of the first which succeeds.
+// Client.mu must not be held, as it's only locked in between attempts, so
+// Close() isn't blocked while dialing.
+func (c *Client) dial(ctx context.Context, dialer Dialer) (conn *ircConn, addr string, err error) {
+	c.mu.RLock()
+	count := len(c.Config.endpoints())
+	c.mu.RUnlock()
+
+	for i := 0; i < count; i++ {
+		c.mu.Lock()
+		if i > 0 {
+			c.rotateEndpoint()
+		}
+
+		c.loadSTSPolicy()
+		addr = c.server()
+
+		endpoint := c.activeEndpoint()
+		c.debug.Printf("connecting to %s... (sts: %v, ssl: %v)", addr, c.state.sts.enabled(), endpoint.SSL)
+		c.mu.Unlock()
+
+		conn, err = newConn(ctx, c.Config, endpoint, dialer, addr, &c.state.sts)
+		if err == nil || ctx.Err() != nil {
+			return conn, addr, err
+		}
+
+		if _, ok := err.(*ErrSTSUpgradeFailed); ok {
+			if !c.state.sts.enabled() {
+				c.RunHandlers(&Event{Command: STS_ERR_FALLBACK})
+			}
+		}
+		c.debug.Printf("unable to connect to %s: %v", addr, err)
+	}
+
+	return nil, addr, err
+}
+
+// connect makes a single connection to the server, returning once the
+// connection has been closed, or parent is done.
+func (c *Client) connect(parent context.Context, mock net.Conn, dialer Dialer) error {
 startConn:
 	// We want to be the only one handling connects/disconnects right now.
 	c.mu.Lock()
 
-	if c.conn != nil {
+	if c.conn != nil || c.dialing {
 		panic("use of connect more than once")
 	}
 
 	// Reset the state.
 	c.state.reset(false)
+	c.seq.reset()
 
 	addr := c.server()
 
+	// Allow Close() to interrupt dialing, as well as the connection.
+	var ctx context.Context
+	ctx, c.stop = context.WithCancel(parent)
+
+	var conn *ircConn
 	if mock == nil {
 		// Validate info, and actually make the connection.
-		c.debug.Printf("connecting to %s... (sts: %v, config-ssl: %v)", addr, c.state.sts.enabled(), c.Config.SSL)
-		conn, err := newConn(c.Config, dialer, addr, &c.state.sts)
+		if err := c.Config.isValid(); err != nil {
+			c.stop()
+			c.mu.Unlock()
+			return err
+		}
+
+		c.dialing = true
+		c.mu.Unlock()
+
+		var err error
+		conn, addr, err = c.dial(ctx, dialer)
+
+		c.mu.Lock()
+		c.dialing = false
+
 		if err != nil {
-			if _, ok := err.(*ErrSTSUpgradeFailed); ok {
-				if !c.state.sts.enabled() {
-					c.RunHandlers(&Event{Command: STS_ERR_FALLBACK})
+			closed := ctx.Err() != nil
+			c.stop()
+
+			if closed {
+				c.mu.Unlock()
+
+				if parent.Err() != nil {
+					return &ErrContextDone{Err: parent.Err()}
 				}
+
+				c.debug.Print("received request to close, cancelling connect")
+				return nil
 			}
+
+			// Start with the endpoint after the last one attempted next time.
+			c.rotateEndpoint()
 			c.mu.Unlock()
 			return err
 		}
-
-		c.conn = conn
 	} else {
-		c.conn = newMockConn(mock)
+		conn = newMockConn(mock)
 	}
 
-	var ctx context.Context
-	ctx, c.stop = context.WithCancel(context.Background())
+	c.conn = conn
 	c.mu.Unlock()
 
-	errs := make(chan error, 4)
+	// Don't penalize the new connection for events sent on the last one.
+	c.resetRateLimiter()
+
+	errs := make(chan error, 5)
 	var wg sync.WaitGroup
-	// 4 being the number of goroutines we need to finish when this function
+	// 5 being the number of goroutines we need to finish when this function
 	// returns.
-	wg.Add(4)
+	wg.Add(5)
 	go c.execLoop(ctx, errs, &wg)
 	go c.readLoop(ctx, errs, &wg)
 	go c.sendLoop(ctx, errs, &wg)
 	go c.pingLoop(ctx, errs, &wg)
+	go c.registerLoop(ctx, errs, &wg)
 
 	// Passwords first.
 
@@ -336,7 +698,10 @@ startConn:
 	c.write(&Event{Command: USER, Params: []string{c.Config.User, "*", "*", c.Config.Name}})
 
 	// Calculate maximum message length for message splitting algorithm
-	c.maxMsgLen = c.getMaxLen()
+	maxMsgLen := c.getMaxLen()
+	c.mu.Lock()
+	c.maxMsgLen = maxMsgLen
+	c.mu.Unlock()
 
 	// Send a virtual event allowing hooks for successful socket connection.
 	c.RunHandlers(&Event{Command: INITIALIZED, Params: []string{addr}})
@@ -345,7 +710,10 @@ startConn:
 	var result error
 	select {
 	case <-ctx.Done():
-		if !c.state.sts.beginUpgrade {
+		if err := parent.Err(); err != nil {
+			c.debug.Printf("context done, beginning clean up: %v", err)
+			result = &ErrContextDone{Err: err}
+		} else if !c.state.sts.beginUpgrade {
 			c.debug.Print("received request to close, beginning clean up")
 		}
 		c.RunHandlers(&Event{Command: CLOSED, Params: []string{addr}})
@@ -374,12 +742,27 @@ startConn:
 	wg.Wait()
 	close(errs)
 
+	// If the server refused our registration, let the user know why, rather
+	// than returning the (less useful) error which closed the connection.
+	if _, ok := result.(*ErrContextDone); !ok && result != nil {
+		c.conn.mu.RLock()
+		if c.conn.regErr != nil {
+			result = c.conn.regErr
+		}
+		c.conn.mu.RUnlock()
+	}
+
 	// This helps ensure that the end user isn't improperly using the client
 	// more than once. If they want to do this, they should be using multiple
 	// clients, not multiple instances of Connect().
 	c.mu.Lock()
 	c.conn = nil
 
+	// Drop anything which couldn't be sent anymore, and stop waiting for
+	// replies which won't be received anymore.
+	c.tx.clear(ErrNotConnected)
+	c.requests.clear(ErrNotConnected)
+
 	if result == nil {
 		if c.state.sts.beginUpgrade {
 			c.state.sts.beginUpgrade = false
@@ -390,6 +773,9 @@ startConn:
 		if c.state.sts.enabled() {
 			c.state.sts.persistenceReceived = time.Now()
 		}
+	} else if mock == nil {
+		// Move on to the next endpoint, in case this one is having issues.
+		c.rotateEndpoint()
 	}
 	c.mu.Unlock()
 
@@ -418,12 +804,17 @@ func (c *Client) readLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 				wg.Done()
 				return
 			}
+			received := time.Now()
 
 			// Check if it's an echo-message.
-			if !c.Config.disableTracking {
-				event.Echo = (event.Command == PRIVMSG || event.Command == NOTICE) &&
-					event.Source != nil && event.Source.ID() == c.GetID()
+			event.Echo = c.isEcho(event)
+
+			if event.Command == PONG {
+				c.observePong(event, received)
+			} else {
+				c.observeClock(event, received)
 			}
+			c.sequence(event, false)
 
 			c.rx <- event
 		}
@@ -435,140 +826,265 @@ func (c *Client) readLoop(ctx context.Context, errs chan error, wg *sync.WaitGro
 // of all events, actually send to the server, is returned to allow for
 // further processing of potentially splitted events. Use
 // Client.RunHandlers() if you are simply looking to trigger handlers
-// with an event.
+// with an event. Use Client.SendContext() to find out whether the event
+// was actually sent. Send blocks while the send queue is full, see
+// Config.SendQueueSize. The Timestamp and Sequence of the events are set
+// once they are written to the connection.
+//
+// If the server supports the draft/multiline capability, a PRIVMSG or
+// NOTICE which contains newlines or exceeds the maximum message length is
+// sent as a multiline batch instead, preserving its newlines. The BATCH
+// events are part of the returned list as well.
 func (c *Client) Send(event *Event) []*Event {
-	events := c.splitEvent(event)
+	priority := c.priority(event)
+
+	events := c.splitOutgoing(event)
 	for _, e := range events {
-		c.sendSingle(e)
+		c.sendSingle(context.Background(), e, priority, nil)
 	}
 	return events
 }
 
-// sendSingle sends a single event to the server. The event is assumed
-// to not exceed the maximum message length.
-func (c *Client) sendSingle(event *Event) {
-	var delay time.Duration
+// SendContext is like Client.Send(), but blocks until each of the (split)
+// events has been written to the connection, one after another. It returns
+// ErrNotConnected if the client is, or got, disconnected before an event
+// could be written, the error which occurred while writing it, or the error
+// of ctx if it is done before then. In the latter case, the event which was
+// being waited on may still be sent, while the remaining events are not.
+func (c *Client) SendContext(ctx context.Context, event *Event) error {
+	priority := c.priority(event)
 
-	if !c.Config.AllowFlood {
-		c.mu.RLock()
+	for _, e := range c.splitOutgoing(event) {
+		done := make(chan error, 1)
+		c.sendSingle(ctx, e, priority, done)
 
-		// Drop the event early as we're disconnected, this way we don't have to wait
-		// the (potentially long) rate limit delay before dropping.
-		if c.conn == nil {
-			c.debugLogEvent(event, true)
-			c.mu.RUnlock()
-			return
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-		c.conn.mu.Lock()
-		delay = c.conn.rate(event.Len())
-		c.conn.mu.Unlock()
-		c.mu.RUnlock()
+	return nil
+}
+
+// splitOutgoing splits event into the events to send, either as multiline
+// batch (see Client.splitMultiline()), or as separate messages (see
+// Client.splitEvent()).
+func (c *Client) splitOutgoing(event *Event) []*Event {
+	if events, ok := c.splitMultiline(event); ok {
+		return events
 	}
 
+	return c.splitEvent(event)
+}
+
+// priority returns the priority event is sent with. See Config.Prioritize.
+func (c *Client) priority(event *Event) Priority {
+	if c.Config.Prioritize == nil {
+		return DefaultPriority(event)
+	}
+
+	return c.Config.Prioritize(event)
+}
+
+// sendSingle queues a single event to be sent to the server with the given
+// priority. The event is assumed to not exceed the maximum message length.
+// See Client.queue() for ctx and done.
+func (c *Client) sendSingle(ctx context.Context, event *Event, priority Priority, done chan error) {
 	if c.Config.GlobalFormat && len(event.Params) > 0 && event.Params[len(event.Params)-1] != "" &&
 		(event.Command == PRIVMSG || event.Command == TOPIC || event.Command == NOTICE) {
 		event.Params[len(event.Params)-1] = Fmt(event.Params[len(event.Params)-1])
 	}
 
-	<-time.After(delay)
-	c.write(event)
+	c.queue(ctx, priority, event, done, false)
 }
 
-// write is the lower level function to write an event. It does not have a
-// write-delay when sending events.
+// write is the lower level function to write an event. The event is always
+// sent as a critical event (see PriorityCritical), and therefore without
+// being delayed by the rate limiter.
 func (c *Client) write(event *Event) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.queue(context.Background(), PriorityCritical, event, nil, true)
+}
 
-	if c.conn == nil {
-		// Drop the event if disconnected.
+// queue adds event to the send queue with the given priority, or drops it if
+// the client is disconnected, or if it's shutting down and the event isn't
+// sent internally. If the queue is full (see Config.SendQueueSize), queue
+// blocks until there is room, or ctx is done, in which case the event is
+// dropped as well. See sendQueue.push() for done.
+func (c *Client) queue(ctx context.Context, priority Priority, event *Event, done chan error, internal bool) {
+	// Wait for room before locking, so disconnecting isn't blocked (which
+	// drains the queue).
+	if err := c.tx.reserve(ctx, priority); err != nil {
 		c.debugLogEvent(event, true)
+		if done != nil {
+			done <- err
+		}
 		return
 	}
-	c.tx <- event
-}
-
-// rate allows limiting events based on how frequent the event is being sent,
-// as well as how many characters each event has.
-func (c *ircConn) rate(chars int) time.Duration {
-	_time := time.Second + ((time.Duration(chars) * time.Second) / 100)
 
-	if c.writeDelay += _time - time.Now().Sub(c.lastWrite); c.writeDelay < 0 {
-		c.writeDelay = 0
-	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	if c.writeDelay > (8 * time.Second) {
-		return _time
+	if c.conn == nil || (c.shutdown && !internal) {
+		// Drop the event if disconnected, or shutting down.
+		c.tx.release(priority)
+		c.debugLogEvent(event, true)
+		if done != nil {
+			if c.conn == nil {
+				done <- ErrNotConnected
+			} else {
+				done <- ErrShuttingDown
+			}
+		}
+		return
 	}
 
-	return 0
+	c.tx.push(priority, event, done)
 }
 
+// sendLoop sends the queued events to the server, in order of their
+// priority, delaying all but critical events according to
+// Config.RateLimiter. Critical events are sent while another event is being
+// delayed.
 func (c *Client) sendLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
 	c.debug.Print("starting sendLoop")
 	defer c.debug.Print("closing sendLoop")
-
-	var err error
+	defer wg.Done()
 
 	for {
-		select {
-		case event := <-c.tx:
-			// Check if tags exist on the event. If they do, and message-tags
-			// isn't a supported capability, remove them from the event.
-			if event.Tags != nil {
-				c.state.RLock()
-				var in bool
-				for i := 0; i < len(c.state.enabledCap); i++ {
-					if _, ok := c.state.enabledCap["message-tags"]; ok {
-						in = true
-						break
-					}
-				}
-				c.state.RUnlock()
+		qe, priority := c.tx.pop(PriorityBulk)
+		if qe == nil {
+			select {
+			case <-c.tx.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
 
-				if !in {
-					event.Tags = Tags{}
+		if priority != PriorityCritical && !c.Config.AllowFlood {
+			delay := time.NewTimer(c.Config.RateLimiter.Delay(qe.event.Len()))
+
+		wait:
+			for {
+				select {
+				case <-delay.C:
+					break wait
+				case <-c.tx.ready:
+					for {
+						critical, _ := c.tx.pop(PriorityCritical)
+						if critical == nil {
+							break
+						}
+
+						if !c.sendQueued(critical, errs) {
+							delay.Stop()
+							c.tx.done(qe, ErrNotConnected)
+							return
+						}
+					}
+				case <-ctx.Done():
+					delay.Stop()
+					c.tx.done(qe, ErrNotConnected)
+					return
 				}
 			}
+		}
 
-			c.debugLogEvent(event, false)
+		if !c.sendQueued(qe, errs) {
+			return
+		}
+	}
+}
 
-			c.conn.mu.Lock()
-			c.conn.lastWrite = time.Now()
+// shuttingDown returns true if Client.Shutdown() is in progress.
+func (c *Client) shuttingDown() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-			if event.Command != PING && event.Command != PONG && event.Command != WHO {
-				c.conn.lastActive = c.conn.lastWrite
-			}
-			c.conn.mu.Unlock()
+	return c.shutdown
+}
 
-			// Write the raw line.
-			_, err = c.conn.io.Write(event.Bytes())
-			if err == nil {
-				// And the \r\n.
-				_, err = c.conn.io.Write(endline)
-				if err == nil {
-					// Lastly, flush everything to the socket.
-					err = c.conn.io.Flush()
-				}
-			}
+// sendQueued writes a queued event to the connection, and reports the
+// result. It returns false if sendLoop should stop, either because of an
+// error, or because the event is a QUIT.
+func (c *Client) sendQueued(qe *queuedEvent, errs chan error) bool {
+	err := c.writeEvent(qe.event)
+	c.tx.done(qe, err)
+
+	// When shutting down, wait for the server to close the connection
+	// instead.
+	if qe.event.Command == QUIT && !c.shuttingDown() {
+		c.Close()
+		return false
+	}
 
-			if event.Command == QUIT {
-				c.Close()
-				wg.Done()
-				return
-			}
+	if err != nil {
+		errs <- err
+		return false
+	}
 
-			if err != nil {
-				errs <- err
-				wg.Done()
-				return
+	return true
+}
+
+// writeEvent writes a single event to the connection.
+func (c *Client) writeEvent(event *Event) (err error) {
+	// Check if tags exist on the event. If they do, and message-tags
+	// isn't a supported capability, remove them from the event.
+	if event.Tags != nil {
+		c.state.RLock()
+		var in bool
+		for i := 0; i < len(c.state.enabledCap); i++ {
+			if _, ok := c.state.enabledCap["message-tags"]; ok {
+				in = true
+				break
+			}
+		}
+		c.state.RUnlock()
+
+		if !in {
+			// The label of a request can be sent with labeled-response alone.
+			if label, ok := event.Tags.Get("label"); ok && c.capEnabled("labeled-response") {
+				event.Tags = Tags{"label": label}
+			} else {
+				event.Tags = Tags{}
 			}
-		case <-ctx.Done():
-			wg.Done()
-			return
 		}
 	}
+
+	c.debugLogEvent(event, false)
+	c.requests.sent(event)
+
+	// Stamp the event right before writing it, as the send queue may
+	// reorder events. The timestamp is in server time, so it's comparable
+	// to the events received from the server.
+	c.sequence(event, true)
+
+	c.conn.mu.Lock()
+	c.conn.lastWrite = time.Now()
+	event.Timestamp = c.conn.lastWrite.Add(c.conn.clockOffset)
+
+	if event.Command != PING && event.Command != PONG && event.Command != WHO {
+		c.conn.lastActive = c.conn.lastWrite
+	}
+	c.conn.mu.Unlock()
+
+	// Write the raw line.
+	_, err = c.conn.io.Write(event.Bytes())
+	if err == nil {
+		// And the \r\n.
+		_, err = c.conn.io.Write(endline)
+		if err == nil {
+			// Lastly, flush everything to the socket.
+			err = c.conn.io.Flush()
+		}
+	}
+
+	return err
 }
 
 // ErrTimedOut is returned when we attempt to ping the server, and timed out
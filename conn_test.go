@@ -7,7 +7,10 @@ package girc
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -75,23 +78,46 @@ func TestEncode(t *testing.T) {
 }
 
 func TestRate(t *testing.T) {
-	_, _, c := mockBuffers()
-	c.lastWrite = time.Now()
-	if delay := c.rate(100); delay > time.Second {
+	l := &PenaltyLimiter{}
+	if delay := l.Delay(100); delay > time.Second {
 		t.Fatal("first instance of rate is > second")
 	}
 
 	for i := 0; i < 500; i++ {
-		c.rate(200)
+		l.Delay(200)
 	}
 
-	if delay := c.rate(200); delay > (3 * time.Second) {
+	if delay := l.Delay(200); delay > (3 * time.Second) {
 		t.Fatal("rate delay too high")
 	}
 
+	// A new connection isn't penalized for the events sent before.
+	l.Reset()
+	if delay := l.Delay(200); delay != 0 {
+		t.Fatalf("PenaltyLimiter.Delay() == %s after reset, want 0", delay)
+	}
+
 	return
 }
 
+func TestTokenBucket(t *testing.T) {
+	b := &TokenBucket{Burst: 3, Refill: time.Second}
+
+	for i := 0; i < 3; i++ {
+		if delay := b.Delay(100); delay != 0 {
+			t.Fatalf("TokenBucket.Delay() == %s within burst, want 0", delay)
+		}
+	}
+
+	// Each following event has to wait for another token.
+	for i := 1; i <= 3; i++ {
+		delay := b.Delay(100)
+		if delay < time.Duration(i)*time.Second-100*time.Millisecond || delay > time.Duration(i)*time.Second {
+			t.Fatalf("TokenBucket.Delay() == %s after burst, want ~%ds", delay, i)
+		}
+	}
+}
+
 func genMockConn() (client *Client, clientConn net.Conn, serverConn net.Conn) {
 	client = New(Config{
 		Server: "dummy.int",
@@ -117,3 +143,261 @@ func mockReadBuffer(conn net.Conn) {
 		}
 	}
 }
+
+func TestReconnectDelay(t *testing.T) {
+	policy := &ReconnectPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := policy.delay(tt.attempt); got != tt.want {
+			t.Fatalf("ReconnectPolicy.delay(%d) == %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(2); got < time.Second || got > 2*time.Second {
+			t.Fatalf("ReconnectPolicy.delay(2) == %s with jitter, want between 1s and 2s", got)
+		}
+	}
+}
+
+// mockDialer hands out one end of a net.Pipe() for each dial, sending the
+// other end to conns.
+type mockDialer struct {
+	conns       chan net.Conn
+	unreachable map[string]bool
+	// addrs receives the dialed addresses, if non-nil.
+	addrs chan string
+}
+
+func (d *mockDialer) Dial(network, address string) (net.Conn, error) {
+	if d.addrs != nil {
+		d.addrs <- address
+	}
+
+	if d.unreachable[address] {
+		return nil, errors.New("connection refused")
+	}
+
+	client, server := net.Pipe()
+	d.conns <- server
+	return client, nil
+}
+
+func TestReconnect(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.Config.Reconnect = &ReconnectPolicy{BaseDelay: 10 * time.Millisecond, MaxAttempts: 1}
+
+	reconnecting := make(chan Event, 5)
+	c.Handlers.Add(RECONNECTING, func(c *Client, e Event) { reconnecting <- e })
+
+	dialer := &mockDialer{conns: make(chan net.Conn, 5)}
+	errs := make(chan error, 1)
+	go func() { errs <- c.DialerConnect(dialer) }()
+
+	// Drop the first connection, which should cause a reconnect.
+	conn := <-dialer.conns
+	conn.Close()
+
+	select {
+	case e := <-reconnecting:
+		if len(e.Params) != 2 || e.Params[0] != "1" || e.Params[1] != "dummy.int:6667" {
+			t.Fatalf("RECONNECTING params == %q, want attempt and address", e.Params)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for RECONNECTING")
+	}
+
+	// Drop the second connection, which exceeds MaxAttempts.
+	select {
+	case conn = <-dialer.conns:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not re-dial the server")
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("DialerConnect() returned nil, want error after exceeding max attempts")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DialerConnect() did not return after exceeding max attempts")
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.Config.Endpoints = []Endpoint{
+		{Server: "down.dummy.int"},
+		{Server: "up.dummy.int", Port: 6697},
+	}
+
+	initialized := make(chan Event, 1)
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { initialized <- e })
+
+	dialer := &mockDialer{
+		conns:       make(chan net.Conn, 5),
+		unreachable: map[string]bool{"down.dummy.int:6667": true},
+	}
+	go c.DialerConnect(dialer)
+	defer c.Close()
+
+	conn := <-dialer.conns
+	defer conn.Close()
+	go mockReadBuffer(conn)
+
+	select {
+	case e := <-initialized:
+		if e.Last() != "up.dummy.int:6697" {
+			t.Fatalf("INITIALIZED trailing == %q, want up.dummy.int:6697", e.Last())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for INITIALIZED")
+	}
+
+	if server := c.Server(); server != "up.dummy.int:6697" {
+		t.Fatalf("Client.Server() == %q, want up.dummy.int:6697", server)
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.Config.Reconnect = &ReconnectPolicy{BaseDelay: 10 * time.Millisecond}
+	c.Config.RejoinChannels = true
+
+	rejoin := make(chan map[string]string, 1)
+	c.Config.HandleRejoin = func(channels map[string]string) map[string]string {
+		rewritten := map[string]string{"#extra": ""}
+		for name, key := range channels {
+			rewritten[name] = key
+		}
+
+		rejoin <- channels
+		return rewritten
+	}
+
+	dialer := &mockDialer{conns: make(chan net.Conn, 5)}
+	go c.DialerConnect(dialer)
+	defer c.Close()
+
+	conn := <-dialer.conns
+	go mockReadBuffer(conn)
+
+	c.Cmd.JoinKey("#keyed", "secret")
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n:test!~test@local.int JOIN #chan\r\n:test!~test@local.int JOIN #keyed\r\n"))
+	c.Cmd.Away("brb")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.ChannelList()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Client.ChannelList() == %q, want 2 channels", c.ChannelList())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Drop the connection, and register again on the new one.
+	conn.Close()
+	conn = <-dialer.conns
+	defer conn.Close()
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+
+	select {
+	case channels := <-rejoin:
+		if len(channels) != 2 || channels["#chan"] != "" || channels["#keyed"] != "secret" {
+			t.Fatalf("HandleRejoin() called with %q, want #chan and #keyed with key", channels)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for HandleRejoin()")
+	}
+
+	want := []string{"JOIN #keyed secret", "JOIN #chan,#extra", "AWAY brb"}
+	b := bufio.NewReader(conn)
+	for len(want) > 0 {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := b.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed waiting for %q: %s", want[0], err)
+		}
+
+		if strings.TrimRight(line, "\r\n") == want[0] {
+			want = want[1:]
+		}
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.Config.Reconnect = &ReconnectPolicy{BaseDelay: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dialer := &mockDialer{conns: make(chan net.Conn, 5)}
+	errs := make(chan error, 1)
+	go func() { errs <- c.DialerConnectContext(ctx, dialer) }()
+
+	conn := <-dialer.conns
+	defer conn.Close()
+	go mockReadBuffer(conn)
+
+	cancel()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("DialerConnectContext() == %v, want error wrapping context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DialerConnectContext() did not return after context was cancelled")
+	}
+
+	if c.IsConnected() {
+		t.Fatal("Client.IsConnected() == true after context was cancelled")
+	}
+}
+
+// mockHangingDialer never connects, until the context of the dial is done.
+type mockHangingDialer struct {
+	dialing chan struct{}
+}
+
+func (d *mockHangingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *mockHangingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialing <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestConnectClose(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	dialer := &mockHangingDialer{dialing: make(chan struct{}, 1)}
+	errs := make(chan error, 1)
+	go func() { errs <- c.DialerConnect(dialer) }()
+
+	<-dialer.dialing
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("DialerConnect() == %v after Client.Close(), want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Client.Close() didn't interrupt dialing")
+	}
+}
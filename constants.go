@@ -28,8 +28,15 @@ const (
 	INITIALIZED      = "CLIENT_INIT"            // verifies successful socket connection, trailing is host:port
 	DISCONNECTED     = "CLIENT_DISCONNECTED"    // occurs when we're disconnected from the server (user-requested or not)
 	CLOSED           = "CLIENT_CLOSED"          // occurs when Client.Close() has been called
+	RECONNECTING     = "CLIENT_RECONNECTING"    // before an automatic reconnection attempt (see Config.Reconnect), params are attempt, host:port
+	RECONNECTED      = "CLIENT_RECONNECTED"     // when the client has registered again after reconnecting, trailing is host:port
 	STS_UPGRADE_INIT = "STS_UPGRADE_INIT"       // when an STS upgrade initially happens.
 	STS_ERR_FALLBACK = "STS_ERR_FALLBACK"       // when an STS connection fails and fallbacks are supported.
+	ECHO_PRIVMSG     = "ECHO_PRIVMSG"           // echo-message of a PRIVMSG sent by the client (see Config.EchoMessage).
+	ECHO_NOTICE      = "ECHO_NOTICE"            // echo-message of a NOTICE sent by the client.
+	ECHO_TAGMSG      = "ECHO_TAGMSG"            // echo-message of a TAGMSG sent by the client.
+	CAP_NEW_NOTIFY   = "CLIENT_CAP_NEW"         // when the server advertises new capabilities (cap-notify), params are the capabilities as advertised.
+	CAP_DEL_NOTIFY   = "CLIENT_CAP_DEL"         // when the server removes capabilities (cap-notify), params are the capabilities.
 )
 
 // User/channel prefixes :: RFC1459.
@@ -271,9 +278,15 @@ const (
 
 // IRCv3 commands and extensions :: http://ircv3.net/irc/.
 const (
+	ACK          = "ACK"
 	AUTHENTICATE = "AUTHENTICATE"
+	BATCH        = "BATCH"
+	CHATHISTORY  = "CHATHISTORY"
+	FAIL         = "FAIL"
 	MONITOR      = "MONITOR"
+	NOTE         = "NOTE"
 	STARTTLS     = "STARTTLS"
+	WARN         = "WARN"
 
 	CAP       = "CAP"
 	CAP_ACK   = "ACK"
@@ -290,6 +303,13 @@ const (
 	CAP_AWAY    = "AWAY"
 	CAP_ACCOUNT = "ACCOUNT"
 	CAP_TAGMSG  = "TAGMSG"
+
+	CHATHISTORY_LATEST  = "LATEST"
+	CHATHISTORY_BEFORE  = "BEFORE"
+	CHATHISTORY_AFTER   = "AFTER"
+	CHATHISTORY_AROUND  = "AROUND"
+	CHATHISTORY_BETWEEN = "BETWEEN"
+	CHATHISTORY_TARGETS = "TARGETS"
 )
 
 // Numeric IRC reply mapping for ircv3 :: http://ircv3.net/irc/.
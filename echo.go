@@ -0,0 +1,123 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrEchoMessageDisabled is returned by Client.SendEcho() if the
+// echo-message capability isn't enabled. See Config.EchoMessage.
+var ErrEchoMessageDisabled = errors.New("echo-message is not enabled")
+
+// Echo is the echo of a message sent with Client.SendEcho(), as sent back by
+// the server.
+type Echo struct {
+	// Event is the echoed event, as received from the server.
+	Event *Event
+	// MsgID is the ID the server assigned to the message, if the server
+	// supports message IDs.
+	MsgID string
+	// Time is the time the server processed the message, if the server
+	// supports server-time, and otherwise the time the echo was received.
+	Time time.Time
+}
+
+// echoCommand returns the virtual command echoes of command are passed to
+// handlers with (e.g. ECHO_PRIVMSG).
+func echoCommand(command string) string {
+	return "ECHO_" + command
+}
+
+// isEcho returns true if event, which was received from the server, is an
+// echo-message of a message sent by us.
+func (c *Client) isEcho(event *Event) bool {
+	if c.Config.disableTracking || event.Source == nil {
+		return false
+	}
+
+	switch event.Command {
+	case PRIVMSG, NOTICE, CAP_TAGMSG:
+		return event.Source.ID() == c.GetID()
+	}
+
+	return false
+}
+
+// isEchoOf returns true if the echo is the echo of the sent event.
+func isEchoOf(echo, sent *Event) bool {
+	if echo.Command != sent.Command || len(echo.Params) != len(sent.Params) || len(echo.Params) == 0 {
+		return false
+	}
+
+	if ToRFC1459(echo.Params[0]) != ToRFC1459(sent.Params[0]) {
+		return false
+	}
+
+	for i := 1; i < len(echo.Params); i++ {
+		if echo.Params[i] != sent.Params[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SendEcho is like Client.SendContext(), but waits for the server to echo
+// each of the (split) events back, and returns the echoes. This requires the
+// echo-message capability (see Config.EchoMessage), and
+// ErrEchoMessageDisabled is returned without it.
+//
+// If the server supports labeled-response, the echoes are matched to the
+// events using labels. Otherwise, the first echo with the same command,
+// target and text is used, and error numerics about the target (e.g.
+// ERR_CANNOTSENDTOCHAN) are matched to the oldest message to it, which is
+// best-effort only. If the server replies with something other than the
+// echo, the error is returned along with the echoes of the events sent
+// before: a *StandardReply for a FAIL standard reply, and an ErrEvent with
+// the reply otherwise (e.g. ERR_CANNOTSENDTOCHAN).
+//
+// Unlike Client.Send(), SendEcho never sends a draft/multiline batch, but
+// always splits the event into separate messages.
+func (c *Client) SendEcho(ctx context.Context, event *Event) ([]*Echo, error) {
+	if !c.capEnabled("echo-message") {
+		return nil, ErrEchoMessageDisabled
+	}
+
+	labeled := c.capEnabled("labeled-response")
+
+	var echoes []*Echo
+	for _, e := range c.splitEvent(event) {
+		var req *pendingRequest
+		if labeled {
+			req = c.requests.add(e, true)
+		} else {
+			req = c.requests.addEcho(e)
+		}
+
+		resp, err := c.request(ctx, e, req)
+		if err != nil {
+			return echoes, err
+		}
+
+		if len(resp.Events) == 0 || resp.Events[0].Command != e.Command {
+			var reply *Event
+			if len(resp.Events) > 0 {
+				reply = resp.Events[0]
+			}
+
+			return echoes, &ErrEvent{Event: reply}
+		}
+
+		echo := &Echo{Event: resp.Events[0], Time: resp.Events[0].Timestamp}
+		echo.MsgID, _ = echo.Event.MsgID()
+
+		echoes = append(echoes, echo)
+	}
+
+	return echoes, nil
+}
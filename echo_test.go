@@ -0,0 +1,102 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func mockEchoClient(t *testing.T, caps string) (*Client, func()) {
+	t.Helper()
+
+	c, server := mockRegistered(t, caps, func(e *Event) []string {
+		if e.Command != PRIVMSG {
+			return nil
+		}
+
+		var tags string
+		if label, ok := e.Tags.Get("label"); ok {
+			tags = "label=" + label + ";"
+		}
+
+		if e.Params[0] == "#banned" {
+			reply := ":dummy.int 404 test #banned :Cannot send to channel"
+			if tags != "" {
+				reply = "@" + tags + " " + reply
+			}
+
+			return []string{
+				// An error for another target, which shouldn't be mixed
+				// up.
+				":dummy.int 404 test #other :Cannot send to channel",
+				reply,
+			}
+		}
+
+		return []string{
+			// An echo of another message, which shouldn't be mixed up.
+			":test!user@host PRIVMSG #other :" + e.Last(),
+			"@" + tags + "msgid=" + e.Last() + ";time=2020-01-02T03:04:05.000Z :test!user@host PRIVMSG " + e.Params[0] + " :" + e.Last(),
+		}
+	}, func(c *Client) { c.Config.EchoMessage = true })
+
+	return c, func() {
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestSendEcho(t *testing.T) {
+	for _, caps := range []string{"echo-message", "echo-message labeled-response batch message-tags"} {
+		c, done := mockEchoClient(t, caps)
+
+		handled := make(chan string, 10)
+		c.Handlers.Add(ECHO_PRIVMSG, func(c *Client, e Event) { handled <- e.Params[0] })
+		c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { t.Errorf("PRIVMSG handler received echo: %s", e.String()) })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		echoes, err := c.SendEcho(ctx, &Event{Command: PRIVMSG, Params: []string{"#channel", "id1"}})
+		if err != nil {
+			t.Fatalf("[%s] Client.SendEcho() == %v", caps, err)
+		}
+
+		if len(echoes) != 1 || echoes[0].MsgID != "id1" || echoes[0].Event.Params[0] != "#channel" {
+			t.Fatalf("[%s] Client.SendEcho() returned %#v", caps, echoes)
+		}
+
+		if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !echoes[0].Time.Equal(want) {
+			t.Fatalf("[%s] Echo.Time == %s, want %s", caps, echoes[0].Time, want)
+		}
+
+		select {
+		case target := <-handled:
+			if target != "#other" && target != "#channel" {
+				t.Fatalf("[%s] ECHO_PRIVMSG handler received echo for %s", caps, target)
+			}
+		case <-ctx.Done():
+			t.Fatalf("[%s] ECHO_PRIVMSG handler wasn't executed", caps)
+		}
+
+		_, err = c.SendEcho(ctx, &Event{Command: PRIVMSG, Params: []string{"#banned", "id2"}})
+		if e, ok := err.(*ErrEvent); !ok || e.Event == nil || e.Event.Command != ERR_CANNOTSENDTOCHAN || e.Event.Params[1] != "#banned" {
+			t.Fatalf("[%s] Client.SendEcho() == %v, want ERR_CANNOTSENDTOCHAN", caps, err)
+		}
+
+		cancel()
+		done()
+	}
+}
+
+func TestSendEchoDisabled(t *testing.T) {
+	c, done := mockEchoClient(t, "labeled-response")
+	defer done()
+
+	if _, err := c.SendEcho(context.Background(), &Event{Command: PRIVMSG, Params: []string{"#channel", "test"}}); err != ErrEchoMessageDisabled {
+		t.Fatalf("Client.SendEcho() == %v, want ErrEchoMessageDisabled", err)
+	}
+}
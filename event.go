@@ -157,6 +157,10 @@ type Event struct {
 	Sensitive bool `json:"sensitive"`
 	// If the event is an echo-message response.
 	Echo bool `json:"echo"`
+	// Sequence is a number which increases monotonically with each event
+	// sent to, or received from the same target (channel or user), if
+	// Config.SequenceEvents is enabled. Zero otherwise.
+	Sequence uint64 `json:"sequence"`
 }
 
 // Last returns the last parameter in Event.Params if it exists.
@@ -180,6 +184,7 @@ func (e *Event) Copy() *Event {
 		Command:   e.Command,
 		Sensitive: e.Sensitive,
 		Echo:      e.Echo,
+		Sequence:  e.Sequence,
 	}
 
 	// Copy Source field, as it's a pointer and needs to be dereferenced.
@@ -17,6 +17,13 @@ import (
 
 // RunHandlers manually runs handlers for a given event.
 func (c *Client) RunHandlers(event *Event) {
+	c.runHandlers(event, true)
+}
+
+// runHandlers runs the handlers for event. If track is false, the internal
+// handlers (which keep track of the state) are skipped, e.g. for past
+// messages replayed by the server.
+func (c *Client) runHandlers(event *Event, track bool) {
 	if event == nil {
 		return
 	}
@@ -34,22 +41,60 @@ func (c *Client) RunHandlers(event *Event) {
 	}
 
 	// Background handlers first. If the event is an echo-message, then only
-	// send the echo version to ALL_EVENTS.
-	c.Handlers.exec(ALL_EVENTS, true, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, true, c, event.Copy())
+	// send the echo version to ALL_EVENTS, and the ECHO_ version of the
+	// command (e.g. ECHO_PRIVMSG).
+	command := event.Command
+	if event.Echo {
+		command = echoCommand(command)
 	}
 
-	c.Handlers.exec(ALL_EVENTS, false, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, false, c, event.Copy())
-	}
+	c.Handlers.exec(ALL_EVENTS, true, track, c, event.Copy())
+	c.Handlers.exec(command, true, track, c, event.Copy())
+
+	c.Handlers.exec(ALL_EVENTS, false, track, c, event.Copy())
+	c.Handlers.exec(command, false, track, c, event.Copy())
 
 	// Check if it's a CTCP.
 	if ctcp := DecodeCTCP(event.Copy()); ctcp != nil {
 		// Execute it.
 		c.CTCP.call(c, ctcp)
 	}
+
+	// Check if it's a standard reply.
+	if reply := DecodeStandardReply(event.Copy()); reply != nil {
+		c.StandardReplies.call(c, reply)
+	}
+}
+
+// runEvent executes the necessary handlers for an event received from the
+// server, keeping track of the batch it belongs to (if any).
+func (c *Client) runEvent(event *Event) {
+	if event == nil {
+		return
+	}
+
+	c.requests.receive(event)
+
+	dispatch, track := c.handleBatch(event)
+	if dispatch {
+		c.runHandlers(event, track)
+		return
+	}
+
+	if !track {
+		// The event is a past message replayed by the server, which mustn't
+		// affect the state.
+		c.debug.Print("< [replay] " + StripRaw(event.String()))
+		return
+	}
+
+	// The event is collected into a batch, which is handled as a whole, but
+	// the state still has to be kept up to date.
+	c.debug.Print("< [batch] " + StripRaw(event.String()))
+	c.Handlers.execInternal(ALL_EVENTS, true, c, event.Copy())
+	c.Handlers.execInternal(event.Command, true, c, event.Copy())
+	c.Handlers.execInternal(ALL_EVENTS, false, c, event.Copy())
+	c.Handlers.execInternal(event.Command, false, c, event.Copy())
 }
 
 // Handler is lower level implementation of a handler. See
@@ -168,17 +213,26 @@ type execStack struct {
 }
 
 // exec executes all handlers pertaining to specified event. Internal first,
-// then external.
+// then external. The internal handlers are skipped if internal is false.
 //
 // Please note that there is no specific order/priority for which the handlers
 // are executed.
-func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
-	// Build a stack of handlers which can be executed concurrently.
-	var stack []execStack
+func (c *Caller) exec(command string, bg, internal bool, client *Client, event *Event) {
+	c.run(c.stack(command, bg, internal, true), command, bg, client, event)
+}
+
+// execInternal is much like exec, however it only executes the internal
+// handlers.
+func (c *Caller) execInternal(command string, bg bool, client *Client, event *Event) {
+	c.run(c.stack(command, bg, true, false), command, bg, client, event)
+}
 
+// stack returns the handlers for command, including the internal handlers
+// if internal is true, and the external handlers if external is true.
+func (c *Caller) stack(command string, bg, internal, external bool) (stack []execStack) {
 	c.mu.RLock()
 	// Get internal handlers first.
-	if _, ok := c.internal[command]; ok {
+	if _, ok := c.internal[command]; ok && internal {
 		for cuid := range c.internal[command] {
 			if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
 				continue
@@ -189,7 +243,7 @@ func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
 	}
 
 	// Then external handlers.
-	if _, ok := c.external[command]; ok {
+	if _, ok := c.external[command]; ok && external {
 		for cuid := range c.external[command] {
 			if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
 				continue
@@ -200,6 +254,11 @@ func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
 	}
 	c.mu.RUnlock()
 
+	return stack
+}
+
+// run executes a stack of handlers against event.
+func (c *Caller) run(stack []execStack, command string, bg bool, client *Client, event *Event) {
 	// Run all handlers concurrently across the same event. This should
 	// still help prevent mis-ordered events, while speeding up the
 	// execution speed.
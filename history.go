@@ -0,0 +1,189 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrChatHistoryDisabled is returned by Client.History() if the server
+// doesn't support the draft/chathistory capability.
+var ErrChatHistoryDisabled = errors.New("chathistory is not supported by the server")
+
+// defaultHistoryLimit is the amount of messages requested with CHATHISTORY if
+// no limit is given, and the server doesn't advertise its maximum.
+const defaultHistoryLimit = 100
+
+// historyTimeFormat is the timestamp format used by CHATHISTORY, which
+// requires millisecond precision.
+const historyTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// HistoryAnchor is a point in the history of a target, used to select the
+// messages returned by CHATHISTORY. It is either a message ID, or a
+// timestamp. The zero value means "no anchor", which is only valid for
+// CHATHISTORY LATEST.
+type HistoryAnchor struct {
+	// MsgID is the ID of a message (see the msgid tag). It takes precedence
+	// over Time.
+	MsgID string
+	// Time is a timestamp, in server time.
+	Time time.Time
+}
+
+// HistoryMsgID returns an anchor at the message with the given ID.
+func HistoryMsgID(msgid string) HistoryAnchor {
+	return HistoryAnchor{MsgID: msgid}
+}
+
+// HistoryTime returns an anchor at the given time.
+func HistoryTime(t time.Time) HistoryAnchor {
+	return HistoryAnchor{Time: t}
+}
+
+// String returns the anchor in the format used by CHATHISTORY, e.g.
+// "msgid=1234", "timestamp=2020-01-02T03:04:05.000Z", or "*" if it's empty.
+func (a HistoryAnchor) String() string {
+	if a.MsgID != "" {
+		return "msgid=" + a.MsgID
+	}
+
+	if a.Time.IsZero() {
+		return "*"
+	}
+
+	return "timestamp=" + a.Time.UTC().Format(historyTimeFormat)
+}
+
+// HistoryQuery selects the messages to request with Client.History().
+type HistoryQuery struct {
+	// Type is the CHATHISTORY subcommand to use, e.g. CHATHISTORY_LATEST or
+	// CHATHISTORY_BEFORE. Defaults to CHATHISTORY_LATEST.
+	Type string
+	// Anchor is the anchor the messages are selected by. For
+	// CHATHISTORY_LATEST, only messages after it are returned, if it's set.
+	// For CHATHISTORY_BETWEEN, this is the start of the range.
+	Anchor HistoryAnchor
+	// End is the end of the range for CHATHISTORY_BETWEEN.
+	End HistoryAnchor
+	// Limit is the maximum amount of messages to return. If it's 0, the
+	// maximum the server allows is used.
+	Limit int
+}
+
+// params returns the parameters of the CHATHISTORY command for the query.
+func (q HistoryQuery) params(target string, limit int) []string {
+	subcommand := strings.ToUpper(q.Type)
+	if subcommand == "" {
+		subcommand = CHATHISTORY_LATEST
+	}
+
+	params := []string{subcommand, target, q.Anchor.String()}
+	if subcommand == CHATHISTORY_BETWEEN {
+		params = append(params, q.End.String())
+	}
+
+	return append(params, strconv.Itoa(limit))
+}
+
+// historyLimit returns limit if it's positive, and otherwise the maximum
+// amount of messages the server allows to be requested with CHATHISTORY.
+func (c *Client) historyLimit(limit int) int {
+	if limit > 0 {
+		return limit
+	}
+
+	c.state.RLock()
+	max, ok := c.state.serverOptions["CHATHISTORY"]
+	c.state.RUnlock()
+
+	if ok {
+		if n, err := strconv.Atoi(max); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	return defaultHistoryLimit
+}
+
+// findBatch returns the first batch of batchType, searching batch itself and
+// the batches nested within it.
+func findBatch(batch *Batch, batchType string) *Batch {
+	if batch == nil {
+		return nil
+	}
+
+	if strings.EqualFold(batch.Type, batchType) {
+		return batch
+	}
+
+	for i := 0; i < len(batch.Batches); i++ {
+		if found := findBatch(batch.Batches[i], batchType); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// History requests the history of target (a channel or a nick) from the
+// server with CHATHISTORY, and returns the messages selected by query,
+// ordered from oldest to newest. This requires the draft/chathistory
+// capability, and ErrChatHistoryDisabled is returned without it.
+//
+// The messages are collected from the chathistory batch the server replies
+// with. The events within chathistory batches aren't passed to event
+// handlers, unless a batch handler for the "chathistory" type has been set
+// up to do so (see Batches.Set).
+//
+// If the server rejects the request with a FAIL standard reply, it's
+// returned as a *StandardReply. If the server supports labeled-response,
+// other error replies are returned as an ErrEvent. Otherwise, History waits
+// until ctx is done if the server doesn't reply at all.
+func (c *Client) History(ctx context.Context, target string, query HistoryQuery) ([]Event, error) {
+	if !c.capEnabled("draft/chathistory") {
+		return nil, ErrChatHistoryDisabled
+	}
+
+	event := &Event{Command: CHATHISTORY, Params: query.params(target, c.historyLimit(query.Limit))}
+
+	var req *pendingRequest
+	if c.capEnabled("labeled-response") {
+		req = c.requests.add(event, true)
+	} else {
+		req = c.requests.addBatch(event, "chathistory", target)
+	}
+
+	resp, err := c.request(ctx, event, req)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := findBatch(resp.Batch, "chathistory")
+	if batch == nil {
+		if len(resp.Events) == 0 {
+			return nil, nil
+		}
+
+		return nil, &ErrEvent{Event: resp.Events[0]}
+	}
+
+	events := make([]Event, len(batch.Events))
+	for i := 0; i < len(batch.Events); i++ {
+		events[i] = *batch.Events[i]
+	}
+
+	// The server should send the messages in order already, however it
+	// doesn't hurt to make sure.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return events, nil
+}
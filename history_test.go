@@ -0,0 +1,109 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		query HistoryQuery
+		want  string
+	}{
+		{HistoryQuery{}, "LATEST #channel * 10"},
+		{HistoryQuery{Type: CHATHISTORY_BEFORE, Anchor: HistoryMsgID("abc")}, "BEFORE #channel msgid=abc 10"},
+		{HistoryQuery{Type: "after", Anchor: HistoryTime(stamp)}, "AFTER #channel timestamp=2020-01-02T03:04:05.000Z 10"},
+		{HistoryQuery{Type: CHATHISTORY_BETWEEN, Anchor: HistoryMsgID("a"), End: HistoryMsgID("b")}, "BETWEEN #channel msgid=a msgid=b 10"},
+	}
+
+	for _, tt := range tests {
+		if got := strings.Join(tt.query.params("#channel", 10), " "); got != tt.want {
+			t.Errorf("HistoryQuery.params() == %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	for _, caps := range []string{"draft/chathistory batch server-time", "draft/chathistory batch server-time labeled-response"} {
+		requests := make(chan string, 10)
+		c, server := mockRegistered(t, caps, func(e *Event) []string {
+			var tags string
+			if label, ok := e.Tags.Get("label"); ok {
+				tags = "label=" + label + " "
+			}
+
+			switch e.Command {
+			case CAP:
+				if e.Params[0] == CAP_END {
+					return []string{
+						":dummy.int 001 test :Welcome",
+						":dummy.int 005 test CHATHISTORY=50 :are supported by this server",
+						":dummy.int 422 test :MOTD File is missing",
+					}
+				}
+			case CHATHISTORY:
+				requests <- strings.Join(e.Params, " ")
+
+				out := []string{
+					// The history of another target, which shouldn't be
+					// mixed up.
+					"BATCH +other chathistory #other",
+					"@batch=other;time=2020-01-02T03:04:05.000Z :nick!user@host PRIVMSG #other :other",
+					"BATCH -other",
+				}
+
+				if tags != "" {
+					out = append(out, "@"+tags+":dummy.int BATCH +h chathistory "+e.Params[1])
+				} else {
+					out = append(out, ":dummy.int BATCH +h chathistory "+e.Params[1])
+				}
+
+				return append(out,
+					"@batch=h;time=2020-01-02T03:04:05.000Z :nick!user@host PRIVMSG "+e.Params[1]+" :first",
+					"@batch=h;time=2020-01-02T03:04:06.000Z :nick!user@host PRIVMSG "+e.Params[1]+" :second",
+					"BATCH -h",
+				)
+			}
+			return nil
+		})
+
+		c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { t.Errorf("[%s] PRIVMSG handler received history: %s", caps, e.String()) })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		events, err := c.History(ctx, "#Channel", HistoryQuery{Type: CHATHISTORY_BEFORE, Anchor: HistoryMsgID("abc")})
+		if err != nil {
+			t.Fatalf("[%s] Client.History() == %v", caps, err)
+		}
+
+		if got := <-requests; got != "BEFORE #Channel msgid=abc 50" {
+			t.Fatalf("[%s] sent CHATHISTORY %s, want BEFORE #Channel msgid=abc 50", caps, got)
+		}
+
+		if len(events) != 2 || events[0].Last() != "first" || events[1].Last() != "second" {
+			t.Fatalf("[%s] Client.History() returned %v", caps, events)
+		}
+
+		cancel()
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	c, server := mockRegistered(t, "", nil)
+	defer c.Close()
+	defer server.Close()
+
+	if _, err := c.History(context.Background(), "#channel", HistoryQuery{}); err != ErrChatHistoryDisabled {
+		t.Fatalf("Client.History() == %v, want ErrChatHistoryDisabled", err)
+	}
+}
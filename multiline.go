@@ -0,0 +1,242 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// multilineBatch is the type of the batches multiline messages are sent in,
+// see https://ircv3.net/specs/extensions/multiline.
+const multilineBatch = "draft/multiline"
+
+// multilineConcat is the tag of the lines of a multiline message which are
+// concatenated to the previous line, rather than separated by a newline.
+const multilineConcat = "draft/multiline-concat"
+
+// batchRefLen is the length of the reference tags of the batches we send.
+const batchRefLen = 10
+
+// newBatchRef returns a random reference tag for a batch.
+func newBatchRef() string {
+	b := make([]byte, batchRefLen)
+
+	for i := range b {
+		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+	}
+
+	return string(b)
+}
+
+// multilineLimits returns the maximum amount of bytes and lines of a
+// multiline message the server accepts. maxLines is 0 if the server doesn't
+// limit the amount of lines. ok is false if the server doesn't support
+// multiline messages.
+func (c *Client) multilineLimits() (maxBytes, maxLines int, ok bool) {
+	c.state.RLock()
+	values, ok := c.state.enabledCap[multilineBatch]
+	_, tags := c.state.enabledCap["message-tags"]
+	c.state.RUnlock()
+
+	// The batch tag can't be sent without message-tags.
+	if !ok || !tags {
+		return 0, 0, false
+	}
+
+	maxBytes, _ = strconv.Atoi(values["max-bytes"])
+	maxLines, _ = strconv.Atoi(values["max-lines"])
+
+	// max-bytes is mandatory.
+	if maxBytes <= 0 {
+		return 0, 0, false
+	}
+
+	if maxLines < 0 {
+		maxLines = 0
+	}
+
+	return maxBytes, maxLines, true
+}
+
+// splitMultiline splits a PRIVMSG or NOTICE containing newlines, or
+// exceeding the maximum message length, into a draft/multiline batch (or
+// several, if it exceeds the limits of the server). Lines are separated by
+// "\n", "\r\n" or "\r". ok is false if the message doesn't have to be
+// split, consists of blank lines only, or the server doesn't support
+// multiline messages, in which case Client.splitEvent() should be used
+// instead.
+func (c *Client) splitMultiline(event *Event) (events []*Event, ok bool) {
+	if (event.Command != PRIVMSG && event.Command != NOTICE) || len(event.Params) != 2 {
+		return nil, false
+	}
+
+	// CTCP messages can't span multiple lines.
+	text := event.Params[1]
+	if len(text) > 0 && text[0] == ctcpDelim {
+		return nil, false
+	}
+
+	// See Client.splitEvent().
+	event.Source = nil
+
+	// The tags are sent with the opening BATCH command, so they don't count
+	// towards the length of the lines.
+	maxLen := c.maxMessageLen()
+	length := (&Event{Command: event.Command, Params: event.Params}).Len()
+	if !strings.ContainsAny(text, "\r\n") && length <= maxLen {
+		return nil, false
+	}
+
+	maxBytes, maxLines, ok := c.multilineLimits()
+	if !ok {
+		return nil, false
+	}
+
+	// Split the text into lines, and the lines exceeding the maximum
+	// message length into parts which are concatenated again by the
+	// receiver.
+	// A lone "\r" is a line break as well.
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+
+	// Batches consisting of blank lines only aren't allowed.
+	if strings.Trim(text, "\n") == "" {
+		return nil, false
+	}
+
+	var lines []*Event
+	for _, line := range strings.Split(text, "\n") {
+		parts := splitPRIVMSG(&Event{Command: event.Command, Params: []string{event.Params[0], line}}, maxLen)
+
+		for i := 1; i < len(parts); i++ {
+			parts[i].Tags = Tags{multilineConcat: ""}
+		}
+		lines = append(lines, parts...)
+	}
+
+	for len(lines) > 0 {
+		// Fill the batch up to the limits of the server, but always include
+		// at least one line.
+		var n, size int
+		for ; n < len(lines) && (maxLines == 0 || n < maxLines); n++ {
+			length := len(lines[n].Params[1])
+			if n > 0 && lines[n].Tags == nil {
+				// The newline separating the line from the previous one.
+				length++
+			}
+
+			if n > 0 && size+length > maxBytes {
+				break
+			}
+			size += length
+		}
+
+		if !blankLines(lines[:n]) {
+			events = append(events, multilineEvents(event, lines[:n])...)
+		}
+		lines = lines[n:]
+	}
+
+	return events, true
+}
+
+// blankLines returns true if all of the lines are blank.
+func blankLines(lines []*Event) bool {
+	for _, line := range lines {
+		if line.Params[1] != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// multilineEvents returns the events of a single multiline batch of event,
+// consisting of lines. The tags of event are sent with the opening BATCH
+// command. If there's only one line, it's sent as a regular message.
+func multilineEvents(event *Event, lines []*Event) []*Event {
+	if len(lines) == 1 {
+		msg := event.Copy()
+		msg.Params[1] = lines[0].Params[1]
+		return []*Event{msg}
+	}
+
+	ref := newBatchRef()
+
+	events := make([]*Event, 0, len(lines)+2)
+	events = append(events, &Event{
+		Tags:    event.Copy().Tags,
+		Command: BATCH,
+		Params:  []string{"+" + ref, multilineBatch, event.Params[0]},
+	})
+
+	for i, line := range lines {
+		_, concat := line.Tags.Get(multilineConcat)
+
+		line.Tags = Tags{"batch": ref}
+		if concat && i > 0 {
+			line.Tags[multilineConcat] = ""
+		}
+		events = append(events, line)
+	}
+
+	return append(events, &Event{Command: BATCH, Params: []string{"-" + ref}})
+}
+
+// joinMultiline returns the message a completed draft/multiline batch
+// consists of, or nil if it doesn't contain any messages. The lines are
+// joined with newlines, unless they are tagged with draft/multiline-concat.
+// The tags of the message are the ones of the opening BATCH command.
+func joinMultiline(batch *Batch) *Event {
+	var msg *Event
+	var text []string
+
+	for _, event := range batch.Events {
+		if (event.Command != PRIVMSG && event.Command != NOTICE) || len(event.Params) < 2 {
+			continue
+		}
+
+		if msg == nil {
+			msg = event.Copy()
+		} else if _, ok := event.Tags.Get(multilineConcat); !ok {
+			text = append(text, "\n")
+		}
+
+		text = append(text, event.Last())
+	}
+
+	if msg == nil {
+		return nil
+	}
+
+	msg.Params = []string{msg.Params[0], strings.Join(text, "")}
+	msg.Tags = batch.Origin.Copy().Tags
+	msg.Tags.Remove("batch")
+
+	return msg
+}
+
+// receiveMultiline handles a completed draft/multiline batch. The message it
+// consists of is added to the enclosing batch (if any), and passed to event
+// handlers if dispatch is true, and the lines haven't been passed to them
+// individually.
+func (c *Client) receiveMultiline(batch *Batch, dispatch bool) {
+	msg := joinMultiline(batch)
+	if msg == nil {
+		return
+	}
+
+	if batch.parent != nil {
+		c.state.Lock()
+		batch.parent.Events = append(batch.parent.Events, msg.Copy())
+		c.state.Unlock()
+	}
+
+	if dispatch && !batch.dispatch {
+		c.runHandlers(msg, !batch.replay)
+	}
+}
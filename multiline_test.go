@@ -0,0 +1,129 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitMultiline(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	// Split lines longer than 10 characters.
+	c.maxMsgLen = (&Event{Command: PRIVMSG, Params: []string{"#foo"}}).Len() + len(" :") + 10
+
+	msg := func(text string) *Event {
+		return &Event{Tags: Tags{"+draft/reply": "x"}, Command: PRIVMSG, Params: []string{"#foo", text}}
+	}
+
+	if _, ok := c.splitMultiline(msg("foo\nbar")); ok {
+		t.Fatal("message was split without draft/multiline")
+	}
+
+	c.state.enabledCap["message-tags"] = nil
+	c.state.enabledCap["draft/multiline"] = map[string]string{"max-bytes": "20", "max-lines": "3"}
+
+	for _, text := range []string{"foo", "\x01ACTION foo\nbar\x01", "\n", "\r\n\r"} {
+		if _, ok := c.splitMultiline(msg(text)); ok {
+			t.Fatalf("%q was split into a multiline batch", text)
+		}
+	}
+
+	events, ok := c.splitMultiline(msg("hello world\nfoo\r\nbar"))
+	if !ok || len(events) < 2 || events[0].Command != BATCH {
+		t.Fatalf("Client.splitMultiline() == %v, %v", events, ok)
+	}
+
+	ref := events[0].Params[0][1:]
+
+	var got []string
+	for _, event := range events {
+		got = append(got, strings.Replace(string(event.Bytes()), ref, "REF", -1))
+	}
+
+	want := []string{
+		"@+draft/reply=x BATCH +REF draft/multiline #foo",
+		"@batch=REF PRIVMSG #foo :hello ",
+		"@batch=REF;draft/multiline-concat PRIVMSG #foo world",
+		"@batch=REF PRIVMSG #foo foo",
+		"BATCH -REF",
+		// The limit of 3 lines has been reached.
+		"@+draft/reply=x PRIVMSG #foo bar",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Client.splitMultiline() ==\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// A lone carriage return is a line break, and the batch of blank lines
+	// exceeding the limit of 3 lines isn't sent.
+	events, ok = c.splitMultiline(msg("a\rb\n\n\n\n\n"))
+	if !ok || len(events) != 5 || events[1].Params[1] != "a" || events[2].Params[1] != "b" {
+		t.Fatalf("Client.splitMultiline() == %v, %v", events, ok)
+	}
+}
+
+const mockMultiline = "@msgid=first :nick!user@host BATCH +ml draft/multiline #channel\r\n" +
+	"@batch=ml :nick!user@host PRIVMSG #channel :hello \r\n" +
+	"@batch=ml;draft/multiline-concat :nick!user@host PRIVMSG #channel world\r\n" +
+	"@batch=ml :nick!user@host PRIVMSG #channel :second line\r\n" +
+	":nick!user@host BATCH -ml\r\n" +
+	":dummy.int BATCH +hist chathistory #channel\r\n" +
+	"@batch=hist;msgid=second :nick!user@host BATCH +old draft/multiline #channel\r\n" +
+	"@batch=old :nick!user@host PRIVMSG #channel :old\r\n" +
+	"@batch=old :nick!user@host PRIVMSG #channel :message\r\n" +
+	"@batch=hist :nick!user@host BATCH -old\r\n" +
+	":dummy.int BATCH -hist\r\n" +
+	":nick!user@host PRIVMSG #channel :outside\r\n"
+
+func TestMultiline(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer c.Close()
+	defer server.Close()
+	go mockReadBuffer(server)
+
+	history := make(chan Batch, 1)
+	c.Batches.Set("chathistory", false, func(c *Client, b Batch) { history <- b })
+
+	events := make(chan Event, 10)
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { events <- e })
+
+	go c.MockConnect(conn)
+
+	if _, err := server.Write([]byte(mockMultiline)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lines are dispatched as a single message, except within the
+	// chathistory batch.
+	for _, want := range []string{"hello world\nsecond line", "outside"} {
+		select {
+		case e := <-events:
+			if e.Last() != want {
+				t.Fatalf("handler received %q, want %q", e.Last(), want)
+			}
+
+			if msgid, _ := e.Tags.Get("msgid"); want != "outside" && msgid != "first" {
+				t.Fatalf("message has msgid %q, want the one of the batch", msgid)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	select {
+	case b := <-history:
+		if len(b.Events) != 1 || b.Events[0].Last() != "old\nmessage" {
+			t.Fatalf("chathistory batch has wrong events: %v", b.Events)
+		}
+
+		if _, ok := b.Events[0].Tags.Get("batch"); ok {
+			t.Fatalf("message within chathistory batch is still tagged: %v", b.Events[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for chathistory batch")
+	}
+}
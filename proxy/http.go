@@ -0,0 +1,96 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTP is a dialer which connects through an HTTP proxy, using the CONNECT
+// method.
+type HTTP struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are used to authenticate with the proxy (using
+	// basic authentication). If Username is empty, no authentication is
+	// attempted.
+	Username string
+	Password string
+	// Header is an optional set of additional headers to send with the
+	// CONNECT request (e.g. User-Agent).
+	Header http.Header
+	// Forward is used to connect to the proxy. Defaults to a net.Dialer.
+	Forward ForwardDialer
+}
+
+// Dial connects to address through the proxy.
+func (d *HTTP) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy, aborting once ctx is
+// done.
+func (d *HTTP) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+
+	return dialProxy(ctx, d.Forward, network, d.Addr, func(conn net.Conn) (net.Conn, error) {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+
+		for key, values := range d.Header {
+			req.Header[key] = values
+		}
+
+		if d.Username != "" {
+			auth := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, &ErrProxy{Proxy: d.Addr, Address: address, Reason: resp.Status}
+		}
+
+		// Many IRC servers send data (e.g. NOTICE AUTH) as soon as the
+		// connection is established, which may already be buffered.
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+
+		return conn, nil
+	})
+}
+
+// bufferedConn is a net.Conn which first returns the data which was read
+// ahead by r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
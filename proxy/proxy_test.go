@@ -0,0 +1,177 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// mockProxy listens on a local port, and passes each accepted connection to
+// handle.
+func mockProxy(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestSOCKS5(t *testing.T) {
+	ln := mockProxy(t, func(conn net.Conn) {
+		// Greeting, offering no authentication and user/pass.
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte{5, 2, 0, 2}) {
+			return
+		}
+		conn.Write([]byte{5, socks5AuthPassword})
+
+		// User/pass authentication.
+		auth := make([]byte, 1+1+4+1+4)
+		io.ReadFull(conn, auth)
+		if string(auth[2:6]) != "user" || string(auth[7:]) != "pass" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		// Connect request with a domain name.
+		req := make([]byte, 5)
+		io.ReadFull(conn, req)
+		host := make([]byte, int(req[4])+2)
+		io.ReadFull(conn, host)
+		if string(host[:len(host)-2]) != "irc.example.com" || host[len(host)-2] != 0x1a || host[len(host)-1] != 0x0b {
+			conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 1})
+		conn.Write([]byte(":irc.example.com NOTICE * :hello\r\n"))
+	})
+	defer ln.Close()
+
+	dialer, err := FromURL("socks5://user:pass@"+ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("FromURL() == %s", err)
+	}
+
+	conn, err := dialer.Dial("tcp", "irc.example.com:6667")
+	if err != nil {
+		t.Fatalf("SOCKS5.Dial() == %s", err)
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != ":irc.example.com NOTICE * :hello\r\n" {
+		t.Fatalf("read %q (%v) through tunnel, want NOTICE", line, err)
+	}
+
+	dialer.(*SOCKS5).Password = "wrong"
+	if _, err = dialer.Dial("tcp", "irc.example.com:6667"); err == nil {
+		t.Fatal("SOCKS5.Dial() with wrong password succeeded")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	ln := mockProxy(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		if req.Method != http.MethodConnect || req.Host != "irc.example.com:6697" {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+
+		if user, pass, ok := parseProxyAuth(req); !ok || user != "user" || pass != "pass" {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+
+		// Send the response and the first line in one write, to make sure
+		// data buffered while reading the response isn't lost.
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n:irc.example.com NOTICE * :hello\r\n"))
+	})
+	defer ln.Close()
+
+	dialer, err := FromURL("http://user:pass@"+ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("FromURL() == %s", err)
+	}
+
+	conn, err := dialer.Dial("tcp", "irc.example.com:6697")
+	if err != nil {
+		t.Fatalf("HTTP.Dial() == %s", err)
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != ":irc.example.com NOTICE * :hello\r\n" {
+		t.Fatalf("read %q (%v) through tunnel, want NOTICE", line, err)
+	}
+
+	dialer.(*HTTP).Username = ""
+	_, err = dialer.Dial("tcp", "irc.example.com:6697")
+	if _, ok := err.(*ErrProxy); !ok {
+		t.Fatalf("HTTP.Dial() without credentials == %v, want *ErrProxy", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// A proxy which never responds.
+	ln := mockProxy(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	dialer := &SOCKS5{Addr: ln.Addr().String()}
+	if _, err := dialer.DialContext(ctx, "tcp", "irc.example.com:6667"); err != context.DeadlineExceeded {
+		t.Fatalf("SOCKS5.DialContext() == %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestFromURL(t *testing.T) {
+	if _, err := FromURL("ftp://127.0.0.1", nil); err == nil {
+		t.Fatal("FromURL() with unsupported scheme succeeded")
+	}
+
+	dialer, err := FromURL("socks5h://127.0.0.1", nil)
+	if err != nil || dialer.(*SOCKS5).Addr != "127.0.0.1:1080" {
+		t.Fatalf("FromURL() == %#v, %v, want SOCKS5 on port 1080", dialer, err)
+	}
+}
+
+func parseProxyAuth(req *http.Request) (user, pass string, ok bool) {
+	req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+	return req.BasicAuth()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthUnacceptable = 0xff
+	socks5AuthPasswordVer  = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// socks5Replies are the reasons for the SOCKS5 reply codes, see RFC 1928
+// section 6.
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5 is a dialer which connects through a SOCKS5 proxy (RFC 1928), with
+// optional username/password authentication (RFC 1929). Hostnames are
+// resolved by the proxy, which is required for e.g. Tor onion services.
+type SOCKS5 struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are used to authenticate with the proxy. If
+	// Username is empty, no authentication is attempted.
+	Username string
+	Password string
+	// Forward is used to connect to the proxy. Defaults to a net.Dialer.
+	Forward ForwardDialer
+}
+
+// Dial connects to address through the proxy.
+func (d *SOCKS5) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy, aborting once ctx is
+// done.
+func (d *SOCKS5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errors.New("proxy: invalid port in address: " + address)
+	}
+
+	return dialProxy(ctx, d.Forward, network, d.Addr, func(conn net.Conn) (net.Conn, error) {
+		if err := d.negotiateAuth(conn); err != nil {
+			return nil, err
+		}
+
+		return conn, d.connect(conn, address, host, port)
+	})
+}
+
+// negotiateAuth selects the authentication method and authenticates if
+// required.
+func (d *SOCKS5) negotiateAuth(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if d.Username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+
+	if resp[0] != socks5Version {
+		return errors.New("proxy: unexpected SOCKS version: " + strconv.Itoa(int(resp[0])))
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if d.Username == "" {
+			break
+		}
+
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("proxy: SOCKS5 username or password too long")
+		}
+
+		req = []byte{socks5AuthPasswordVer, byte(len(d.Username))}
+		req = append(req, d.Username...)
+		req = append(req, byte(len(d.Password)))
+		req = append(req, d.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+
+		if resp[1] != 0x00 {
+			return &ErrProxy{Proxy: d.Addr, Reason: "authentication failed"}
+		}
+
+		return nil
+	}
+
+	return &ErrProxy{Proxy: d.Addr, Reason: "no acceptable authentication methods"}
+}
+
+// connect requests the proxy to connect to host:port.
+func (d *SOCKS5) connect(conn net.Conn, address, host string, port int) error {
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddrIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddrIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("proxy: hostname too long: " + host)
+		}
+
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER, REP, RSV, ATYP.
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+
+	if resp[1] != 0x00 {
+		reason, ok := socks5Replies[resp[1]]
+		if !ok {
+			reason = "unknown error " + strconv.Itoa(int(resp[1]))
+		}
+
+		return &ErrProxy{Proxy: d.Addr, Address: address, Reason: reason}
+	}
+
+	// Discard the bound address and port, which we have no use for.
+	var skip int
+	switch resp[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len + 2
+	case socks5AddrIPv6:
+		skip = net.IPv6len + 2
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0]) + 2
+	default:
+		return errors.New("proxy: unknown SOCKS5 address type: " + strconv.Itoa(int(resp[3])))
+	}
+
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
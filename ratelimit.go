@@ -0,0 +1,144 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which events are sent to the server, to
+// prevent the client from being disconnected for flooding. See
+// Config.RateLimiter, as well as TokenBucket and PenaltyLimiter for the
+// implementations provided by girc.
+type RateLimiter interface {
+	// Delay is called for each event before it is sent, in the order the
+	// events are sent, with the length of the event in bytes. It returns
+	// how long the event has to wait before it can be sent, and should
+	// account for the event as if it were sent at that point. Delay must be
+	// safe for concurrent use.
+	//
+	// If the RateLimiter also has a Reset() method, it's called each time
+	// the client connects to the server, before any events are sent.
+	Delay(length int) time.Duration
+}
+
+// resetRateLimiter resets the rate limiter of the client for a new
+// connection, if it supports it. See RateLimiter.
+func (c *Client) resetRateLimiter() {
+	if r, ok := c.Config.RateLimiter.(interface{ Reset() }); ok {
+		r.Reset()
+	}
+}
+
+// Defaults used by TokenBucket.
+const (
+	DefaultBurst  = 8
+	DefaultRefill = time.Second
+)
+
+// TokenBucket is a token bucket RateLimiter, which is the default rate
+// limiter. Each event consumes a token, and the bucket holds at most Burst
+// tokens, which are refilled at a rate of one token per Refill. Events are
+// delayed while the bucket is empty. The zero value is ready to use.
+type TokenBucket struct {
+	// Burst is the maximum amount of events which can be sent at once,
+	// before they are being delayed. Defaults to DefaultBurst.
+	Burst int
+	// Refill is the time it takes to refill a single token, i.e. the
+	// sustained rate at which events can be sent. Defaults to DefaultRefill.
+	Refill time.Duration
+
+	mu sync.Mutex
+	// tokens are the tokens in the bucket at the time of last, which is
+	// negative if events are waiting for tokens to be refilled.
+	tokens float64
+	last   time.Time
+}
+
+// Delay consumes a token, returning how long to wait for it to be refilled
+// if the bucket is empty.
+func (b *TokenBucket) Delay(length int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst, refill := float64(b.Burst), b.Refill
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	if refill <= 0 {
+		refill = DefaultRefill
+	}
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += float64(now.Sub(b.last)) / float64(refill)
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens * float64(refill))
+}
+
+// Reset refills the bucket.
+func (b *TokenBucket) Reset() {
+	b.mu.Lock()
+	b.last = time.Time{}
+	b.mu.Unlock()
+}
+
+// PenaltyLimiter is a RateLimiter which keeps track of a penalty, similar to
+// the flood protection of many ircds. Each event adds a penalty of one
+// second, plus one second per 100 bytes, which decays in real time from the
+// time the last event was sent. Once the penalty exceeds 8 seconds, events
+// are delayed by their own penalty. The penalty is cleared when the client
+// connects. This was the behavior of girc before RateLimiter was
+// introduced. The zero value is ready to use.
+type PenaltyLimiter struct {
+	mu      sync.Mutex
+	penalty time.Duration
+	// last is the time the last event was sent, i.e. once its delay had
+	// passed.
+	last time.Time
+}
+
+// Delay adds the penalty for an event of length bytes, returning how long
+// to wait if the penalty is exceeded.
+func (l *PenaltyLimiter) Delay(length int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cost := time.Second + ((time.Duration(length) * time.Second) / 100)
+	now := time.Now()
+
+	if l.penalty += cost - now.Sub(l.last); l.penalty < 0 {
+		l.penalty = 0
+	}
+
+	var delay time.Duration
+	if l.penalty > (8 * time.Second) {
+		delay = cost
+	}
+	l.last = now.Add(delay)
+
+	return delay
+}
+
+// Reset clears the penalty.
+func (l *PenaltyLimiter) Reset() {
+	l.mu.Lock()
+	l.penalty = 0
+	l.last = time.Time{}
+	l.mu.Unlock()
+}
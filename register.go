@@ -0,0 +1,167 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRegistrationTimeout is returned when the server did not accept our
+// registration (by sending RPL_WELCOME) within Config.RegisterTimeout.
+type ErrRegistrationTimeout struct {
+	// Timeout is the configured registration timeout.
+	Timeout time.Duration
+}
+
+func (e ErrRegistrationTimeout) Error() string {
+	return fmt.Sprintf("server did not accept registration within %s", e.Timeout)
+}
+
+// ErrCapNegotiation is returned when the registration timed out (see
+// Config.RegisterTimeout) while the client was still negotiating IRCv3
+// capabilities (or authenticating with SASL) with the server.
+type ErrCapNegotiation struct {
+	// Timeout is the configured registration timeout.
+	Timeout time.Duration
+}
+
+func (e ErrCapNegotiation) Error() string {
+	return fmt.Sprintf("capability negotiation did not complete within %s", e.Timeout)
+}
+
+// ErrBadPassword is returned when the server rejected the configured server
+// password (ERR_PASSWDMISMATCH).
+type ErrBadPassword struct {
+	Event *Event // Event is the event sent by the server.
+}
+
+func (e ErrBadPassword) Error() string { return "server rejected password: " + e.Event.Last() }
+
+// ErrBanned is returned when the server refused the connection, as the
+// client is banned from the server (ERR_YOUREBANNEDCREEP, e.g. a K-line).
+type ErrBanned struct {
+	Event *Event // Event is the event sent by the server.
+}
+
+func (e ErrBanned) Error() string { return "banned from server: " + e.Event.Last() }
+
+// ErrNickUnusable is returned when the server refused the nickname during
+// registration, and no other nickname could be tried (ERR_ERRONEUSNICKNAME).
+// See Config.HandleNickCollide for nicknames that are already in use.
+type ErrNickUnusable struct {
+	Nick  string // Nick is the nickname which was refused.
+	Event *Event // Event is the event sent by the server.
+}
+
+func (e ErrNickUnusable) Error() string {
+	return fmt.Sprintf("nickname %q refused by server: %s", e.Nick, e.Event.Last())
+}
+
+// ErrSASLFailed is returned when authentication using Config.SASL failed
+// during registration.
+type ErrSASLFailed struct {
+	Method string // Method is the SASL mechanism used, e.g. "PLAIN".
+	Event  *Event // Event is the event sent by the server.
+}
+
+func (e ErrSASLFailed) Error() string {
+	return fmt.Sprintf("SASL %s authentication failed: %s", e.Method, e.Event.Last())
+}
+
+// registerLoop waits for the server to accept our registration, and fails
+// the connection if this doesn't happen within Config.RegisterTimeout.
+func (c *Client) registerLoop(ctx context.Context, errs chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if c.Config.RegisterTimeout <= 0 {
+		return
+	}
+
+	c.debug.Print("starting registerLoop")
+	defer c.debug.Print("closing registerLoop")
+
+	timer := time.NewTimer(c.Config.RegisterTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		c.conn.mu.RLock()
+		capPending := c.conn.capPending
+		c.conn.mu.RUnlock()
+
+		if capPending {
+			errs <- ErrCapNegotiation{Timeout: c.Config.RegisterTimeout}
+			return
+		}
+
+		errs <- ErrRegistrationTimeout{Timeout: c.Config.RegisterTimeout}
+	case <-c.conn.registered:
+	case <-ctx.Done():
+	}
+}
+
+// registrationFailed records why the server refused our registration, which
+// is returned from Connect() in place of the error that ended the
+// connection. Returns false (and records nothing) if already registered.
+func (c *Client) registrationFailed(err error) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.conn == nil || c.conn.isRegistered() {
+		return false
+	}
+
+	c.conn.mu.Lock()
+	if c.conn.regErr == nil {
+		c.conn.regErr = err
+	}
+	c.conn.mu.Unlock()
+
+	return true
+}
+
+// registered returns true if the server has accepted our registration on
+// the current connection.
+func (c *Client) registered() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.conn != nil && c.conn.isRegistered()
+}
+
+// handleRegisterError handles numerics which indicate that the server
+// refused our registration. Some of these are also sent after registration
+// (e.g. ERR_PASSWDMISMATCH for a failed OPER), in which case they are
+// ignored.
+func handleRegisterError(c *Client, e Event) {
+	var err error
+
+	switch e.Command {
+	case ERR_PASSWDMISMATCH:
+		err = ErrBadPassword{Event: e.Copy()}
+	case ERR_YOUREBANNEDCREEP:
+		err = ErrBanned{Event: e.Copy()}
+	case ERR_ERRONEUSNICKNAME:
+		var nick string
+		if len(e.Params) > 2 {
+			nick = e.Params[1]
+		}
+
+		err = ErrNickUnusable{Nick: nick, Event: e.Copy()}
+	default:
+		return
+	}
+
+	if !c.registrationFailed(err) {
+		return
+	}
+
+	// The server should close the connection on its own, however make sure
+	// that we don't stay connected in limbo if it doesn't.
+	c.rx <- &Event{Command: ERROR, Params: []string{"closing connection: " + err.Error()}}
+}
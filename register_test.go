@@ -0,0 +1,64 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"testing"
+	"time"
+)
+
+func mockRegister(t *testing.T, timeout time.Duration, lines string) error {
+	t.Helper()
+
+	c, conn, server := genMockConn()
+	c.Config.RegisterTimeout = timeout
+	defer server.Close()
+
+	go mockReadBuffer(server)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.MockConnect(conn) }()
+
+	if lines != "" {
+		server.Write([]byte(lines))
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		c.Close()
+		t.Fatal("MockConnect() did not return")
+	}
+
+	return nil
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	err := mockRegister(t, 100*time.Millisecond, "")
+	if _, ok := err.(ErrRegistrationTimeout); !ok {
+		t.Fatalf("MockConnect() == %#v, want ErrRegistrationTimeout", err)
+	}
+
+	err = mockRegister(t, 100*time.Millisecond, ":dummy.int CAP * LS :multi-prefix\r\n")
+	if _, ok := err.(ErrCapNegotiation); !ok {
+		t.Fatalf("MockConnect() == %#v, want ErrCapNegotiation", err)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	err := mockRegister(t, 0, ":dummy.int 464 * :Password incorrect\r\n")
+	if _, ok := err.(ErrBadPassword); !ok {
+		t.Fatalf("MockConnect() == %#v, want ErrBadPassword", err)
+	}
+	if DefaultRetryable(err) {
+		t.Fatal("DefaultRetryable(ErrBadPassword) == true, want false")
+	}
+
+	err = mockRegister(t, 0, ":dummy.int 432 * test :Erroneous nickname\r\n")
+	if e, ok := err.(ErrNickUnusable); !ok || e.Nick != "test" {
+		t.Fatalf("MockConnect() == %#v, want ErrNickUnusable for test", err)
+	}
+}
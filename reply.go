@@ -0,0 +1,161 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"sync"
+)
+
+// StandardReply is an IRCv3 standard reply (FAIL, WARN or NOTE), see
+// https://ircv3.net/specs/extensions/standard-replies. FAIL replies are
+// returned as errors by Client.Request() and the like.
+type StandardReply struct {
+	// Origin is the original event that the standard reply was decoded from.
+	Origin *Event `json:"origin"`
+	// Type is the type of the reply, i.e. FAIL, WARN or NOTE.
+	Type string `json:"type"`
+	// Command is the command the reply relates to (e.g. CHATHISTORY), or
+	// "*" if it doesn't relate to a specific command.
+	Command string `json:"command"`
+	// Code is the machine-readable code of the reply, e.g. INVALID_TARGET.
+	Code string `json:"code"`
+	// Context are the additional parameters of the reply, which depend on
+	// the code.
+	Context []string `json:"context"`
+	// Description is the human-readable description of the reply.
+	Description string `json:"description"`
+}
+
+// Error returns the reply in a readable format, e.g.
+// "FAIL CHATHISTORY INVALID_TARGET #channel: description".
+func (r StandardReply) Error() string {
+	out := r.Type + " " + r.Command + " " + r.Code
+	if len(r.Context) > 0 {
+		out += " " + strings.Join(r.Context, " ")
+	}
+
+	return out + ": " + r.Description
+}
+
+// DecodeStandardReply decodes an incoming standard reply. nil is returned if
+// the event isn't a (valid) FAIL, WARN or NOTE.
+func DecodeStandardReply(e *Event) *StandardReply {
+	if e == nil || len(e.Params) < 3 {
+		return nil
+	}
+
+	if e.Command != FAIL && e.Command != WARN && e.Command != NOTE {
+		return nil
+	}
+
+	reply := &StandardReply{
+		Origin:      e,
+		Type:        e.Command,
+		Command:     strings.ToUpper(e.Params[0]),
+		Code:        e.Params[1],
+		Description: e.Last(),
+	}
+
+	if len(e.Params) > 3 {
+		reply.Context = make([]string, len(e.Params)-3)
+		copy(reply.Context, e.Params[2:len(e.Params)-1])
+	}
+
+	return reply
+}
+
+// replyError returns the first FAIL reply among events as an error, if
+// any.
+func replyError(events []*Event) error {
+	for i := 0; i < len(events); i++ {
+		if reply := DecodeStandardReply(events[i]); reply != nil && reply.Type == FAIL {
+			return reply
+		}
+	}
+
+	return nil
+}
+
+// StandardReplyHandler is a type that represents the function necessary to
+// implement a standard reply handler.
+type StandardReplyHandler func(client *Client, reply StandardReply)
+
+// StandardReplies handles the storage and execution of handlers against
+// incoming standard replies. The events are passed to FAIL, WARN and NOTE
+// event handlers as usual as well.
+type StandardReplies struct {
+	// mu is the mutex that should be used when accessing any handlers.
+	mu sync.RWMutex
+	// handlers is a map of command -> handler.
+	handlers map[string]StandardReplyHandler
+}
+
+// newStandardReplies returns a new clean standard reply handler.
+func newStandardReplies() *StandardReplies {
+	return &StandardReplies{handlers: map[string]StandardReplyHandler{}}
+}
+
+// call executes the handlers for an incoming standard reply.
+func (r *StandardReplies) call(client *Client, reply *StandardReply) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// If they want to catch any panics, add to defer stack.
+	if client.Config.RecoverFunc != nil && reply.Origin != nil {
+		defer recoverHandlerPanic(client, reply.Origin, "reply-"+strings.ToLower(reply.Command), 3)
+	}
+
+	// Wildcard handlers get executed first, like with CTCP.
+	if handler, ok := r.handlers["*"]; ok {
+		handler(client, *reply)
+	}
+
+	if reply.Command == "*" {
+		return
+	}
+
+	if handler, ok := r.handlers[reply.Command]; ok {
+		handler(client, *reply)
+	}
+}
+
+// Set saves handler for execution upon incoming standard replies relating
+// to command (e.g. CHATHISTORY). Use SetBg if the handler may take an
+// extended period of time to execute. If you would like to have a handler
+// which will catch ALL standard replies, simply use "*" in place of the
+// command.
+func (r *StandardReplies) Set(command string, handler func(client *Client, reply StandardReply)) {
+	if command == "" {
+		return
+	}
+
+	r.mu.Lock()
+	r.handlers[strings.ToUpper(command)] = StandardReplyHandler(handler)
+	r.mu.Unlock()
+}
+
+// SetBg is much like Set, however the handler is executed in the background,
+// ensuring that event handling isn't hung during long running tasks. See Set
+// for more information.
+func (r *StandardReplies) SetBg(command string, handler func(client *Client, reply StandardReply)) {
+	r.Set(command, func(client *Client, reply StandardReply) {
+		go handler(client, reply)
+	})
+}
+
+// Clear removes currently setup handler for command, if one is set.
+func (r *StandardReplies) Clear(command string) {
+	r.mu.Lock()
+	delete(r.handlers, strings.ToUpper(command))
+	r.mu.Unlock()
+}
+
+// ClearAll removes all currently setup standard reply handlers.
+func (r *StandardReplies) ClearAll() {
+	r.mu.Lock()
+	r.handlers = map[string]StandardReplyHandler{}
+	r.mu.Unlock()
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeStandardReply(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want *StandardReply
+	}{
+		{
+			raw: ":dummy.int FAIL CHATHISTORY INVALID_TARGET #channel :Messages could not be retrieved",
+			want: &StandardReply{
+				Type: FAIL, Command: CHATHISTORY, Code: "INVALID_TARGET",
+				Context: []string{"#channel"}, Description: "Messages could not be retrieved",
+			},
+		},
+		{
+			raw:  ":dummy.int NOTE * OPER_MESSAGE :The message",
+			want: &StandardReply{Type: NOTE, Command: "*", Code: "OPER_MESSAGE", Description: "The message"},
+		},
+		{raw: ":dummy.int WARN REHASH :Missing code", want: nil},
+		{raw: ":dummy.int PRIVMSG #channel code :text", want: nil},
+	}
+
+	for _, tt := range tests {
+		got := DecodeStandardReply(ParseEvent(tt.raw))
+		if got != nil {
+			got.Origin = nil
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DecodeStandardReply(%q) == %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+
+	reply := DecodeStandardReply(ParseEvent(tests[0].raw))
+	if want := "FAIL CHATHISTORY INVALID_TARGET #channel: Messages could not be retrieved"; reply.Error() != want {
+		t.Errorf("StandardReply.Error() == %q, want %q", reply.Error(), want)
+	}
+}
+
+func TestStandardReplies(t *testing.T) {
+	for _, caps := range []string{"", "labeled-response batch message-tags"} {
+		c, server := mockRegistered(t, caps, func(e *Event) []string {
+			if e.Command != LIST {
+				return nil
+			}
+
+			var tags string
+			if label, ok := e.Tags.Get("label"); ok {
+				tags = "@label=" + label + " "
+			}
+
+			return []string{
+				// Unrelated to the request.
+				":dummy.int NOTE * NOTICE :Something happened",
+				tags + ":dummy.int FAIL LIST TOO_MANY_RESULTS :Too many channels",
+			}
+		})
+
+		replies := make(chan StandardReply, 10)
+		c.StandardReplies.Set("*", func(c *Client, reply StandardReply) { replies <- reply })
+		c.StandardReplies.Set(LIST, func(c *Client, reply StandardReply) { replies <- reply })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		_, err := c.Request(ctx, &Event{Command: LIST})
+		if reply, ok := err.(*StandardReply); !ok || reply.Code != "TOO_MANY_RESULTS" {
+			t.Fatalf("[%s] Client.Request() == %v, want FAIL LIST", caps, err)
+		}
+
+		var codes []string
+		for len(codes) < 3 {
+			select {
+			case reply := <-replies:
+				codes = append(codes, reply.Code)
+			case <-ctx.Done():
+				t.Fatalf("[%s] handlers received %q, want NOTICE and TOO_MANY_RESULTS twice", caps, codes)
+			}
+		}
+
+		if !reflect.DeepEqual(codes, []string{"NOTICE", "TOO_MANY_RESULTS", "TOO_MANY_RESULTS"}) {
+			t.Fatalf("[%s] handlers received %q, want NOTICE and TOO_MANY_RESULTS twice", caps, codes)
+		}
+
+		cancel()
+		c.Close()
+		server.Close()
+	}
+}
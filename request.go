@@ -0,0 +1,546 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response is the reply of the server to an event sent with
+// Client.Request().
+type Response struct {
+	// Label is the label the request was sent with, if the server supports
+	// the labeled-response capability.
+	Label string
+	// Events are the events the server replied with, in the order they have
+	// been received. If the reply is a batch, these are the events within
+	// the batch. Empty if the server acknowledged the request without
+	// replying otherwise.
+	Events []*Event
+	// Batch is the labeled-response batch the server replied with, if any.
+	Batch *Batch
+}
+
+// ErrLabeledResponseDisabled is returned by Client.Request() if the
+// labeled-response capability isn't enabled, and the reply to the command
+// can't be told apart from other numerics.
+var ErrLabeledResponseDisabled = errors.New("labeled-response is not enabled")
+
+// requestEnd maps commands to the numerics which end their reply, used to
+// match replies to requests if the server doesn't support labeled-response.
+// Requests for commands which aren't listed can only be sent with a label.
+var requestEnd = map[string][]string{
+	AWAY:     {RPL_UNAWAY, RPL_NOWAWAY},
+	INFO:     {RPL_ENDOFINFO},
+	ISON:     {RPL_ISON},
+	LINKS:    {RPL_ENDOFLINKS},
+	LIST:     {RPL_LISTEND},
+	MODE:     {RPL_CHANNELMODEIS, RPL_UMODEIS, RPL_ENDOFBANLIST, RPL_ENDOFEXCEPTLIST, RPL_ENDOFINVITELIST},
+	MONITOR:  {RPL_ENDOFMONLIST},
+	MOTD:     {RPL_ENDOFMOTD, ERR_NOMOTD},
+	NAMES:    {RPL_ENDOFNAMES},
+	STATS:    {RPL_ENDOFSTATS},
+	TIME:     {RPL_TIME},
+	TOPIC:    {RPL_NOTOPIC, RPL_TOPICWHOTIME},
+	USERHOST: {RPL_USERHOST},
+	WHO:      {RPL_ENDOFWHO},
+	WHOIS:    {RPL_ENDOFWHOIS},
+	WHOWAS:   {RPL_ENDOFWHOWAS},
+}
+
+// isNumeric returns true if command is a numeric reply.
+func isNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+
+	for i := 0; i < len(command); i++ {
+		if command[i] < '0' || command[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// endsRequest returns true if the numeric event ends the reply to a request
+// for command.
+func endsRequest(command string, event *Event) bool {
+	// Errors end any reply.
+	if event.Command[0] == '4' || event.Command[0] == '5' {
+		return true
+	}
+
+	end := requestEnd[command]
+	for i := 0; i < len(end); i++ {
+		if event.Command == end[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pendingRequest is a request waiting for its reply.
+type pendingRequest struct {
+	label   string
+	command string
+	events  []*Event
+	// sent is the event the request was sent with, if the request is
+	// waiting for its echo.
+	sent *Event
+	// batch and target are the type and target of the batch the request is
+	// waiting for, if it can't be labeled.
+	batch  string
+	target string
+	// caps are the capabilities requested with CAP REQ, sorted.
+	caps []string
+	// done is closed once resp or err is set.
+	done chan struct{}
+	resp *Response
+	err  error
+}
+
+// pendingRequests keeps track of the requests waiting for their reply. It is
+// safe for concurrent use.
+type pendingRequests struct {
+	mu sync.Mutex
+	// next is the number used for the next label.
+	next uint64
+	// labels are the requests sent with a label, keyed by their label.
+	labels map[string]*pendingRequest
+	// unsent are the requests without a label which haven't been sent yet,
+	// keyed by their event.
+	unsent map[*Event]*pendingRequest
+	// numeric are the requests without a label which have been sent, in
+	// the order they have been sent.
+	numeric []*pendingRequest
+	// echoes are the requests without a label waiting for their echo, in
+	// the order they have been added.
+	echoes []*pendingRequest
+	// batches are the requests without a label waiting for a batch, in the
+	// order they have been added.
+	batches []*pendingRequest
+	// caps are the CAP REQ requests waiting for CAP ACK or CAP NAK, in the
+	// order they have been added.
+	caps []*pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		labels: make(map[string]*pendingRequest),
+		unsent: make(map[*Event]*pendingRequest),
+	}
+}
+
+// add registers a request for event, labeling it if labeled is true.
+func (p *pendingRequests) add(event *Event, labeled bool) *pendingRequest {
+	req := &pendingRequest{command: strings.ToUpper(event.Command), done: make(chan struct{})}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !labeled {
+		p.unsent[event] = req
+		return req
+	}
+
+	p.next++
+	req.label = "girc" + strconv.FormatUint(p.next, 36)
+
+	if event.Tags == nil {
+		event.Tags = Tags{}
+	}
+	event.Tags["label"] = req.label
+	p.labels[req.label] = req
+
+	return req
+}
+
+// addEcho registers a request waiting for the echo of event, if it can't be
+// labeled.
+func (p *pendingRequests) addEcho(event *Event) *pendingRequest {
+	req := &pendingRequest{command: strings.ToUpper(event.Command), sent: event, done: make(chan struct{})}
+
+	p.mu.Lock()
+	p.echoes = append(p.echoes, req)
+	p.mu.Unlock()
+
+	return req
+}
+
+// addBatch registers a request waiting for a batch of batchType, whose first
+// parameter is target, if event can't be labeled.
+func (p *pendingRequests) addBatch(event *Event, batchType, target string) *pendingRequest {
+	req := &pendingRequest{
+		command: strings.ToUpper(event.Command),
+		batch:   batchType,
+		target:  ToRFC1459(target),
+		done:    make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	p.batches = append(p.batches, req)
+	p.mu.Unlock()
+
+	return req
+}
+
+// addCap registers a request waiting for the server to acknowledge or reject
+// the capabilities requested with CAP REQ.
+func (p *pendingRequests) addCap(caps []string) *pendingRequest {
+	req := &pendingRequest{command: CAP, caps: make([]string, len(caps)), done: make(chan struct{})}
+	copy(req.caps, caps)
+	sort.Strings(req.caps)
+
+	p.mu.Lock()
+	p.caps = append(p.caps, req)
+	p.mu.Unlock()
+
+	return req
+}
+
+// remove stops waiting for the reply to req.
+func (p *pendingRequests) remove(req *pendingRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if req.label != "" {
+		delete(p.labels, req.label)
+		return
+	}
+
+	for event := range p.unsent {
+		if p.unsent[event] == req {
+			delete(p.unsent, event)
+		}
+	}
+
+	for i := 0; i < len(p.numeric); i++ {
+		if p.numeric[i] == req {
+			p.numeric = append(p.numeric[:i], p.numeric[i+1:]...)
+			break
+		}
+	}
+
+	for i := 0; i < len(p.echoes); i++ {
+		if p.echoes[i] == req {
+			p.echoes = append(p.echoes[:i], p.echoes[i+1:]...)
+			break
+		}
+	}
+
+	for i := 0; i < len(p.batches); i++ {
+		if p.batches[i] == req {
+			p.batches = append(p.batches[:i], p.batches[i+1:]...)
+			break
+		}
+	}
+
+	for i := 0; i < len(p.caps); i++ {
+		if p.caps[i] == req {
+			p.caps = append(p.caps[:i], p.caps[i+1:]...)
+			break
+		}
+	}
+}
+
+// sent is called right before event is written to the connection, so
+// numeric replies can be matched in the order the requests were sent.
+func (p *pendingRequests) sent(event *Event) {
+	p.mu.Lock()
+	if req, ok := p.unsent[event]; ok {
+		delete(p.unsent, event)
+		p.numeric = append(p.numeric, req)
+	}
+	p.mu.Unlock()
+}
+
+// receive matches an event received from the server against the pending
+// requests.
+func (p *pendingRequests) receive(event *Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if label, ok := event.Tags.Get("label"); ok {
+		// Labeled batches are matched once they are complete.
+		if event.Command == BATCH {
+			return
+		}
+
+		req, ok := p.labels[label]
+		if !ok {
+			return
+		}
+		delete(p.labels, label)
+
+		req.resp = &Response{Label: label}
+		if event.Command != ACK {
+			req.resp.Events = []*Event{event.Copy()}
+		}
+		close(req.done)
+		return
+	}
+
+	if event.Echo {
+		for i := 0; i < len(p.echoes); i++ {
+			if !isEchoOf(event, p.echoes[i].sent) {
+				continue
+			}
+
+			req := p.echoes[i]
+			p.echoes = append(p.echoes[:i], p.echoes[i+1:]...)
+			req.resp = &Response{Events: []*Event{event.Copy()}}
+			close(req.done)
+			return
+		}
+		return
+	}
+
+	if _, ok := batchRef(event); ok {
+		return
+	}
+
+	if reply := DecodeStandardReply(event); reply != nil && reply.Type == FAIL {
+		p.fail(event, reply.Command)
+		return
+	}
+
+	if !isNumeric(event.Command) {
+		return
+	}
+
+	if p.echoError(event) || len(p.numeric) == 0 {
+		return
+	}
+
+	req := p.numeric[0]
+	req.events = append(req.events, event.Copy())
+
+	if endsRequest(req.command, event) {
+		p.numeric = p.numeric[1:]
+		req.resp = &Response{Events: req.events}
+		close(req.done)
+	}
+}
+
+// echoError ends the oldest request waiting for the echo of a message to
+// the target of event, if event is an error numeric (4xx) about a target
+// (e.g. ERR_CANNOTSENDTOCHAN). It returns true if a request was ended.
+func (p *pendingRequests) echoError(event *Event) bool {
+	if event.Command[0] != '4' || len(event.Params) < 3 {
+		return false
+	}
+
+	target := ToRFC1459(event.Params[1])
+	for i := 0; i < len(p.echoes); i++ {
+		req := p.echoes[i]
+		if len(req.sent.Params) == 0 || ToRFC1459(req.sent.Params[0]) != target {
+			continue
+		}
+
+		p.echoes = append(p.echoes[:i], p.echoes[i+1:]...)
+		req.resp = &Response{Events: []*Event{event.Copy()}}
+		close(req.done)
+		return true
+	}
+
+	return false
+}
+
+// fail ends the first pending request without a label for command with the
+// FAIL event, if any.
+func (p *pendingRequests) fail(event *Event, command string) {
+	for _, list := range []*[]*pendingRequest{&p.numeric, &p.batches, &p.echoes} {
+		for i := 0; i < len(*list); i++ {
+			req := (*list)[i]
+			if req.command != command {
+				continue
+			}
+
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			req.resp = &Response{Events: append(req.events, event.Copy())}
+			close(req.done)
+			return
+		}
+	}
+}
+
+// receiveBatch matches a completed batch against the pending requests.
+func (p *pendingRequests) receiveBatch(batch *Batch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if label, ok := batch.Origin.Tags.Get("label"); ok {
+		req, ok := p.labels[label]
+		if !ok {
+			return
+		}
+		delete(p.labels, label)
+
+		batch = batch.Copy()
+		req.resp = &Response{Label: label, Events: batch.Events, Batch: batch}
+		close(req.done)
+		return
+	}
+
+	if len(batch.Params) == 0 {
+		return
+	}
+
+	for i := 0; i < len(p.batches); i++ {
+		req := p.batches[i]
+		if !strings.EqualFold(req.batch, batch.Type) || req.target != ToRFC1459(batch.Params[0]) {
+			continue
+		}
+
+		p.batches = append(p.batches[:i], p.batches[i+1:]...)
+
+		batch = batch.Copy()
+		req.resp = &Response{Events: batch.Events, Batch: batch}
+		close(req.done)
+		return
+	}
+}
+
+// receiveCap matches a CAP ACK or CAP NAK event against the pending CAP REQ
+// requests, and returns true if it's the reply to one of them. As the server
+// replies with the list of capabilities as requested, replies are matched by
+// the list.
+func (p *pendingRequests) receiveCap(event *Event) bool {
+	caps := strings.Fields(event.Last())
+	sort.Strings(caps)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < len(p.caps); i++ {
+		req := p.caps[i]
+		if strings.Join(req.caps, " ") != strings.Join(caps, " ") {
+			continue
+		}
+
+		p.caps = append(p.caps[:i], p.caps[i+1:]...)
+
+		if event.Params[1] == CAP_NAK {
+			req.err = ErrCapRejected{Caps: req.caps}
+		} else {
+			req.resp = &Response{Events: []*Event{event.Copy()}}
+		}
+		close(req.done)
+		return true
+	}
+
+	return false
+}
+
+// clear fails all pending requests with err.
+func (p *pendingRequests) clear(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, req := range p.labels {
+		req.err = err
+		close(req.done)
+	}
+
+	for _, req := range p.unsent {
+		req.err = err
+		close(req.done)
+	}
+
+	for _, req := range p.numeric {
+		req.err = err
+		close(req.done)
+	}
+
+	for _, req := range p.echoes {
+		req.err = err
+		close(req.done)
+	}
+
+	for _, req := range p.batches {
+		req.err = err
+		close(req.done)
+	}
+
+	for _, req := range p.caps {
+		req.err = err
+		close(req.done)
+	}
+
+	p.labels = make(map[string]*pendingRequest)
+	p.unsent = make(map[*Event]*pendingRequest)
+	p.numeric = nil
+	p.echoes = nil
+	p.batches = nil
+	p.caps = nil
+}
+
+// Request sends an event to the server, and waits for the reply to it. The
+// event is not split, unlike with Client.Send().
+//
+// If the server supports the labeled-response capability, the event is sent
+// with a label, and the events the server labeled with it are returned, be
+// it a single event, a batch, or just an acknowledgement. Otherwise,
+// Request falls back to returning the numeric replies following the event:
+// up to and including the numeric which ends the reply (e.g. RPL_ENDOFWHOIS
+// for WHOIS), or an error numeric. As other numerics may be received in the
+// mean time, this is best-effort only, and only possible for commands with
+// a known reply (like WHOIS, WHO, NAMES, LIST or MOTD). For other commands
+// (like PRIVMSG), ErrLabeledResponseDisabled is returned without sending
+// the event.
+//
+// If the reply contains a FAIL standard reply, it's returned as error (a
+// *StandardReply), along with the response. Without labeled-response, FAIL
+// replies are matched to the oldest request for the command they relate to.
+//
+// ErrNotConnected is returned if the client is (or got) disconnected before
+// the reply has been received, and the error of ctx if it is done before
+// then.
+func (c *Client) Request(ctx context.Context, event *Event) (*Response, error) {
+	labeled := c.capEnabled("labeled-response")
+	if _, ok := requestEnd[strings.ToUpper(event.Command)]; !ok && !labeled {
+		return nil, ErrLabeledResponseDisabled
+	}
+
+	event = event.Copy()
+	return c.request(ctx, event, c.requests.add(event, labeled))
+}
+
+// request sends event, which req has been registered for, and waits for the
+// reply to it.
+func (c *Client) request(ctx context.Context, event *Event, req *pendingRequest) (*Response, error) {
+	done := make(chan error, 1)
+	c.sendSingle(ctx, event, c.priority(event), done)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			c.requests.remove(req)
+			return nil, err
+		}
+	case <-ctx.Done():
+		c.requests.remove(req)
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-req.done:
+		if req.err != nil {
+			return nil, req.err
+		}
+
+		return req.resp, replyError(req.resp.Events)
+	case <-ctx.Done():
+		c.requests.remove(req)
+		return nil, ctx.Err()
+	}
+}
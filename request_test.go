@@ -0,0 +1,193 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockServer passes each line the client sends to reply, and writes the
+// lines it returns back to the client.
+func mockServer(conn net.Conn, reply func(e *Event) []string) {
+	b := bufio.NewReader(conn)
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		for _, out := range reply(ParseEvent(line)) {
+			if _, err = conn.Write([]byte(out + "\r\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// mockRegistered connects a mock client to a mock server, and waits for
+// the end of the registration, i.e. ERR_NOMOTD (rather than for CONNECTED,
+// which is delayed). The server advertises caps, acknowledges all capability
+// requests and welcomes the client after CAP END. Each line the client sends
+// is passed to extra (if non-nil) first, and the default replies are only
+// used if it returns nil. The client is passed to each of the setup
+// functions before connecting.
+func mockRegistered(t *testing.T, caps string, extra func(e *Event) []string, setup ...func(c *Client)) (*Client, net.Conn) {
+	t.Helper()
+
+	c, conn, server := genMockConn()
+	for _, fn := range setup {
+		fn(c)
+	}
+
+	go mockServer(server, func(e *Event) []string {
+		if extra != nil {
+			if out := extra(e); out != nil {
+				return out
+			}
+		}
+
+		if e.Command != CAP {
+			return nil
+		}
+
+		switch e.Params[0] {
+		case CAP_LS:
+			return []string{":dummy.int CAP * LS :" + caps}
+		case CAP_REQ:
+			return []string{":dummy.int CAP * ACK :" + e.Last()}
+		case CAP_END:
+			return []string{":dummy.int 001 test :Welcome", ":dummy.int 422 test :MOTD File is missing"}
+		}
+		return nil
+	})
+
+	registered := make(chan struct{})
+	c.Handlers.Add(ERR_NOMOTD, func(c *Client, e Event) { close(registered) })
+	go c.MockConnect(conn)
+
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		c.Close()
+		server.Close()
+		t.Fatal("timed out waiting for registration")
+	}
+
+	return c, server
+}
+
+func TestRequest(t *testing.T) {
+	c, server := mockRegistered(t, "", func(e *Event) []string {
+		switch e.Command {
+		case WHOIS:
+			return []string{
+				":dummy.int 311 test nick user host * :Real Name",
+				":dummy.int 318 test nick :End of /WHOIS list",
+			}
+		case TIME:
+			return []string{
+				":dummy.int 421 test TIME :Unknown command",
+			}
+		}
+		return nil
+	})
+	defer c.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.Request(ctx, &Event{Command: WHOIS, Params: []string{"nick"}})
+	if err != nil {
+		t.Fatalf("Client.Request(WHOIS) == %v", err)
+	}
+
+	if len(resp.Events) != 2 || resp.Events[0].Command != RPL_WHOISUSER || resp.Events[1].Command != RPL_ENDOFWHOIS {
+		t.Fatalf("Client.Request(WHOIS) returned %v, want RPL_WHOISUSER and RPL_ENDOFWHOIS", resp.Events)
+	}
+
+	resp, err = c.Request(ctx, &Event{Command: TIME})
+	if err != nil {
+		t.Fatalf("Client.Request(TIME) == %v", err)
+	}
+
+	if len(resp.Events) != 1 || resp.Events[0].Command != ERR_UNKNOWNCOMMAND {
+		t.Fatalf("Client.Request(TIME) returned %v, want ERR_UNKNOWNCOMMAND", resp.Events)
+	}
+
+	// Without labeled-response, the reply to a PRIVMSG couldn't be told
+	// apart from unrelated numerics.
+	if _, err = c.Request(ctx, &Event{Command: PRIVMSG, Params: []string{"#a", "test"}}); err != ErrLabeledResponseDisabled {
+		t.Fatalf("Client.Request(PRIVMSG) == %v, want ErrLabeledResponseDisabled", err)
+	}
+}
+
+func TestRequestLabeled(t *testing.T) {
+	c, server := mockRegistered(t, "batch labeled-response message-tags", func(e *Event) []string {
+		label, _ := e.Tags.Get("label")
+
+		switch e.Command {
+		case WHOIS:
+			return []string{
+				// Unrelated numerics shouldn't get in the way.
+				":dummy.int 311 test other user host * :Real Name",
+				"@label=" + label + " :dummy.int BATCH +ref labeled-response",
+				"@batch=ref :dummy.int 311 test nick user host * :Real Name",
+				"@batch=ref :dummy.int 318 test nick :End of /WHOIS list",
+				":dummy.int BATCH -ref",
+			}
+		case TOPIC:
+			return []string{"@label=" + label + " :dummy.int 332 test #channel :topic"}
+		case PRIVMSG:
+			return []string{"@label=" + label + " :dummy.int ACK"}
+		}
+		return nil
+	})
+	defer c.Close()
+	defer server.Close()
+
+	if !c.HasCapability("labeled-response") {
+		t.Fatal("labeled-response wasn't negotiated")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.Request(ctx, &Event{Command: WHOIS, Params: []string{"nick"}})
+	if err != nil {
+		t.Fatalf("Client.Request(WHOIS) == %v", err)
+	}
+
+	if resp.Label == "" || resp.Batch == nil || resp.Batch.Type != "labeled-response" {
+		t.Fatalf("Client.Request(WHOIS) returned %#v, want labeled-response batch", resp)
+	}
+
+	if len(resp.Events) != 2 || resp.Events[0].Params[1] != "nick" || resp.Events[1].Command != RPL_ENDOFWHOIS {
+		t.Fatalf("Client.Request(WHOIS) returned %v, want the batched events", resp.Events)
+	}
+
+	resp, err = c.Request(ctx, &Event{Command: TOPIC, Params: []string{"#channel"}})
+	if err != nil {
+		t.Fatalf("Client.Request(TOPIC) == %v", err)
+	}
+
+	if len(resp.Events) != 1 || resp.Events[0].Last() != "topic" {
+		t.Fatalf("Client.Request(TOPIC) returned %v, want RPL_TOPIC", resp.Events)
+	}
+
+	resp, err = c.Request(ctx, &Event{Command: PRIVMSG, Params: []string{"#channel", "test"}})
+	if err != nil {
+		t.Fatalf("Client.Request(PRIVMSG) == %v", err)
+	}
+
+	if len(resp.Events) != 0 || !strings.HasPrefix(resp.Label, "girc") {
+		t.Fatalf("Client.Request(PRIVMSG) returned %#v, want ACK", resp)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority is the priority class of an outgoing event. Events waiting to be
+// sent are always sent in order of their priority class, and messages of the
+// same class are sent round-robin between their targets (see
+// Config.Prioritize), so a single busy channel or query can't delay the
+// replies to all other targets. Other commands (e.g. JOIN) are never sent
+// after any event of the same class which was queued after them.
+type Priority int
+
+const (
+	// PriorityCritical is used for protocol-critical events, like PONG, CAP
+	// and AUTHENTICATE, which would otherwise cause the connection to time
+	// out or registration to stall. Critical events are never delayed by
+	// Config.RateLimiter, and are sent even while another event is being
+	// delayed.
+	PriorityCritical Priority = iota
+	// PriorityInteractive is used for messages and commands which are
+	// usually a direct reply to another user, and is the default priority.
+	PriorityInteractive
+	// PriorityBulk is used for events which can wait, like WHO requests
+	// and other informational queries.
+	PriorityBulk
+
+	numPriorities = int(PriorityBulk) + 1
+)
+
+// String returns the name of the priority class.
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	}
+
+	return "unknown"
+}
+
+// DefaultSendQueueSize is the default of Config.SendQueueSize.
+const DefaultSendQueueSize = 100
+
+// clampPriority returns p, or the closest valid priority class if p isn't
+// valid.
+func clampPriority(p Priority) Priority {
+	if p < PriorityCritical {
+		return PriorityCritical
+	} else if int(p) >= numPriorities {
+		return PriorityBulk
+	}
+
+	return p
+}
+
+// DefaultPriority is the default Config.Prioritize function. PING, PONG,
+// CAP, AUTHENTICATE, PASS, WEBIRC, USER and QUIT are critical, while WHO,
+// WHOIS, WHOWAS, LIST, NAMES, ISON, USERHOST, MONITOR and mode queries are
+// bulk. All other events are interactive.
+func DefaultPriority(event *Event) Priority {
+	switch event.Command {
+	case PING, PONG, CAP, AUTHENTICATE, PASS, WEBIRC, USER, QUIT:
+		return PriorityCritical
+	case WHO, WHOIS, WHOWAS, LIST, NAMES, ISON, USERHOST, MONITOR:
+		return PriorityBulk
+	case MODE:
+		if len(event.Params) < 2 {
+			return PriorityBulk
+		}
+	}
+
+	return PriorityInteractive
+}
+
+// queueTarget returns the key used to queue events fairly between targets.
+// Messages are keyed by their target, and channel commands (e.g. JOIN) by
+// their channel (or list of channels), so they're sent in order with the
+// messages to the channel. All other events share the same key. See
+// sendQueue.target() for the events of batches.
+func queueTarget(event *Event) string {
+	if len(event.Params) == 0 {
+		return ""
+	}
+
+	switch event.Command {
+	case PRIVMSG, NOTICE, CAP_TAGMSG, JOIN, PART, TOPIC, MODE, KICK:
+		return ToRFC1459(event.Params[0])
+	}
+
+	return ""
+}
+
+// isQueuedMessage returns true if event is a message, which is queued
+// round-robin between targets. Other events are queued first in, first out
+// (see fairQueue).
+func isQueuedMessage(event *Event) bool {
+	switch event.Command {
+	case PRIVMSG, NOTICE, CAP_TAGMSG, BATCH:
+		return true
+	}
+
+	return false
+}
+
+// queuedEvent is an event waiting in the send queue.
+type queuedEvent struct {
+	event *Event
+	// done optionally receives the result of sending the event, and must be
+	// buffered.
+	done chan error
+	// target is the key the event is queued with, and seq the order in
+	// which it was queued.
+	target string
+	seq    uint64
+}
+
+// finish reports the result of sending the event, if requested.
+func (qe *queuedEvent) finish(err error) {
+	if qe.done != nil {
+		qe.done <- err
+	}
+}
+
+// fairQueue is a queue of events, in which messages are dequeued round-robin
+// between their targets. All other events (see isQueuedMessage) are
+// dequeued before any event queued after them, and therefore in the order
+// they were queued.
+type fairQueue struct {
+	// targets holds the pending events per target, in the order they were
+	// queued.
+	targets map[string][]*queuedEvent
+	// order holds the targets with pending events, in the order they are
+	// served.
+	order []string
+	// fifo holds the pending events which aren't messages, in the order
+	// they were queued.
+	fifo []*queuedEvent
+	// seq is the amount of events queued so far.
+	seq uint64
+}
+
+func (q *fairQueue) push(target string, event *queuedEvent) {
+	if q.targets == nil {
+		q.targets = make(map[string][]*queuedEvent)
+	}
+
+	q.seq++
+	event.target, event.seq = target, q.seq
+
+	if !isQueuedMessage(event.event) {
+		q.fifo = append(q.fifo, event)
+	}
+
+	if _, ok := q.targets[target]; !ok {
+		q.order = append(q.order, target)
+	}
+	q.targets[target] = append(q.targets[target], event)
+}
+
+func (q *fairQueue) pop() *queuedEvent {
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	target := q.order[0]
+
+	// Serve the target of the oldest event which isn't a message out of
+	// turn, if the next event in turn was queued after it.
+	turn := true
+	if len(q.fifo) > 0 && q.fifo[0].seq < q.targets[target][0].seq {
+		target, turn = q.fifo[0].target, q.fifo[0].target == target
+	}
+
+	events := q.targets[target]
+	event := events[0]
+	events[0] = nil
+
+	if len(q.fifo) > 0 && q.fifo[0] == event {
+		q.fifo[0] = nil
+		q.fifo = q.fifo[1:]
+	}
+
+	if turn {
+		q.order = q.order[1:]
+	}
+
+	if len(events) == 1 {
+		delete(q.targets, target)
+
+		if !turn {
+			q.remove(target)
+		}
+	} else {
+		q.targets[target] = events[1:]
+
+		// Move the target to the back of the line, if it was its turn.
+		if turn {
+			q.order = append(q.order, target)
+		}
+	}
+
+	return event
+}
+
+// remove removes target from the order in which targets are served.
+func (q *fairQueue) remove(target string) {
+	for i := range q.order {
+		if q.order[i] == target {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendQueue holds the events waiting to be sent, by priority class. It is
+// safe for concurrent use.
+type sendQueue struct {
+	mu      sync.Mutex
+	classes [numPriorities]fairQueue
+	// len is the amount of queued events.
+	len int
+	// pending is the amount of queued events, plus the amount of events
+	// which have been popped, but not yet marked as done.
+	pending int
+	// idle is closed once pending drops to zero.
+	idle chan struct{}
+	// ready is signalled whenever an event is pushed.
+	ready chan struct{}
+	// batches are the targets of the batches being queued, keyed by their
+	// reference tag.
+	batches map[string]string
+	// slots holds a value for each queued non-critical event, limiting their
+	// amount to its capacity. It's nil if the amount isn't limited.
+	slots chan struct{}
+}
+
+// newSendQueue returns a new send queue, which holds up to size
+// non-critical events. If size isn't positive, the amount isn't limited.
+func newSendQueue(size int) *sendQueue {
+	q := &sendQueue{ready: make(chan struct{}, 1)}
+	if size > 0 {
+		q.slots = make(chan struct{}, size)
+	}
+
+	return q
+}
+
+// reserve blocks until there is room for another event with the given
+// priority, or ctx is done, in which case its error is returned. Critical
+// events are never blocked. The room must be used with sendQueue.push(), or
+// given back with sendQueue.release().
+func (q *sendQueue) reserve(ctx context.Context, priority Priority) error {
+	if q.slots == nil || clampPriority(priority) == PriorityCritical {
+		return nil
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives back the room reserved for an event with the given
+// priority, once it has left the queue.
+func (q *sendQueue) release(priority Priority) {
+	if q.slots == nil || clampPriority(priority) == PriorityCritical {
+		return
+	}
+
+	select {
+	case <-q.slots:
+	default:
+	}
+}
+
+// push queues event with the given priority, for which room has to be
+// reserved with sendQueue.reserve() first. If done is not nil, the result
+// of sending the event is sent to it once the event has been written to the
+// connection or dropped.
+func (q *sendQueue) push(priority Priority, event *Event, done chan error) {
+	priority = clampPriority(priority)
+
+	q.mu.Lock()
+	q.classes[priority].push(q.target(event), &queuedEvent{event: event, done: done})
+	q.len++
+	q.pending++
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// target returns the key event is queued with (see queueTarget). The
+// events of a batch (e.g. a draft/multiline batch), including the BATCH
+// commands opening and closing it, are queued with the target of the batch,
+// so the batch is sent in order with the other messages to the same target.
+// q.mu must be held.
+func (q *sendQueue) target(event *Event) string {
+	if event.Command == BATCH && len(event.Params) > 0 && len(event.Params[0]) > 1 {
+		ref := event.Params[0][1:]
+
+		switch event.Params[0][0] {
+		case '+':
+			var target string
+			if len(event.Params) > 2 {
+				target = ToRFC1459(event.Params[2])
+			}
+
+			if q.batches == nil {
+				q.batches = make(map[string]string)
+			}
+			q.batches[ref] = target
+
+			return target
+		case '-':
+			target := q.batches[ref]
+			delete(q.batches, ref)
+
+			return target
+		}
+	}
+
+	if ref, ok := batchRef(event); ok {
+		if target, ok := q.batches[ref]; ok {
+			return target
+		}
+	}
+
+	return queueTarget(event)
+}
+
+// pop dequeues the next event with a priority of at least max (i.e.
+// PriorityCritical only returns critical events), or nil if there is none.
+// The priority of the returned event is returned as well. Each popped event
+// must be passed to sendQueue.done() once it has been sent or dropped.
+func (q *sendQueue) pop(max Priority) (*queuedEvent, Priority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p := PriorityCritical; p <= max && int(p) < numPriorities; p++ {
+		if event := q.classes[p].pop(); event != nil {
+			q.len--
+			q.release(p)
+			return event, p
+		}
+	}
+
+	return nil, max
+}
+
+// done reports the result of sending a popped event.
+func (q *sendQueue) done(event *queuedEvent, err error) {
+	event.finish(err)
+
+	q.mu.Lock()
+	q.setPending(q.pending - 1)
+	q.mu.Unlock()
+}
+
+// setPending updates the amount of pending events. q.mu must be held.
+func (q *sendQueue) setPending(pending int) {
+	q.pending = pending
+
+	if q.pending == 0 && q.idle != nil {
+		close(q.idle)
+		q.idle = nil
+	}
+}
+
+// clear drops all queued events, reporting err for each of them.
+func (q *sendQueue) clear(err error) {
+	q.mu.Lock()
+	classes := q.classes
+	for i := range q.classes {
+		q.classes[i] = fairQueue{}
+	}
+	q.batches = nil
+	q.setPending(q.pending - q.len)
+	q.len = 0
+	q.mu.Unlock()
+
+	for i := range classes {
+		for event := classes[i].pop(); event != nil; event = classes[i].pop() {
+			q.release(Priority(i))
+			event.finish(err)
+		}
+	}
+}
+
+// drained returns a channel which is closed once all queued events have been
+// sent or dropped.
+func (q *sendQueue) drained() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+
+	if q.idle == nil {
+		q.idle = make(chan struct{})
+	}
+
+	return q.idle
+}
+
+// Len returns the amount of events which are queued, or are being sent.
+func (q *sendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pending
+}
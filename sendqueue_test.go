@@ -0,0 +1,320 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(0)
+
+	for _, raw := range []string{
+		"PRIVMSG #a 1",
+		"PRIVMSG #a 2",
+		"WHO #a",
+		"PRIVMSG #a 3",
+		"PRIVMSG #b 1",
+		"PONG token",
+		"PRIVMSG #c 1",
+		"PRIVMSG #b 2",
+	} {
+		e := ParseEvent(raw)
+		q.push(DefaultPriority(e), e, nil)
+	}
+
+	if q.Len() != 8 {
+		t.Fatalf("sendQueue.Len() == %d, want 8", q.Len())
+	}
+
+	want := []string{
+		"PONG token",
+		"PRIVMSG #a 1",
+		"PRIVMSG #b 1",
+		"PRIVMSG #c 1",
+		"PRIVMSG #a 2",
+		"PRIVMSG #b 2",
+		"PRIVMSG #a 3",
+		"WHO #a",
+	}
+
+	for _, w := range want {
+		qe, _ := q.pop(PriorityBulk)
+		if qe == nil {
+			t.Fatalf("sendQueue.pop() == nil, want %q", w)
+		}
+		if qe.event.String() != w {
+			t.Fatalf("sendQueue.pop() == %q, want %q", qe.event.String(), w)
+		}
+
+		select {
+		case <-q.drained():
+			t.Fatal("sendQueue.drained() closed with pending events")
+		default:
+		}
+		q.done(qe, nil)
+	}
+
+	if qe, _ := q.pop(PriorityBulk); qe != nil {
+		t.Fatalf("sendQueue.pop() == %q on empty queue", qe.event.String())
+	}
+
+	if q.Len() != 0 {
+		t.Fatalf("sendQueue.Len() == %d on empty queue, want 0", q.Len())
+	}
+
+	select {
+	case <-q.drained():
+	default:
+		t.Fatal("sendQueue.drained() not closed on empty queue")
+	}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	tests := []struct {
+		events []string
+		want   []string
+	}{
+		// Channel commands are sent in order with the messages to the channel.
+		{
+			events: []string{"JOIN #a", "JOIN #b", "PRIVMSG #b x", "NICK other", "PRIVMSG #a y"},
+			want:   []string{"JOIN #a", "JOIN #b", "NICK other", "PRIVMSG #a y", "PRIVMSG #b x"},
+		},
+		// Other commands aren't sent after the events queued after them.
+		{
+			events: []string{"PRIVMSG #b 1", "PRIVMSG #b 2", "JOIN #b", "PRIVMSG #x 1"},
+			want:   []string{"PRIVMSG #b 1", "PRIVMSG #b 2", "JOIN #b", "PRIVMSG #x 1"},
+		},
+		{
+			events: []string{"NICK a", "PRIVMSG #a 1", "AWAY brb", "NICK b", "PRIVMSG #a 2"},
+			want:   []string{"NICK a", "PRIVMSG #a 1", "AWAY brb", "NICK b", "PRIVMSG #a 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		q := newSendQueue(0)
+		for _, raw := range tt.events {
+			e := ParseEvent(raw)
+			q.push(DefaultPriority(e), e, nil)
+		}
+
+		for _, w := range tt.want {
+			qe, _ := q.pop(PriorityBulk)
+			if qe == nil {
+				t.Fatalf("sendQueue.pop() == nil for %q, want %q", tt.events, w)
+			}
+			if qe.event.String() != w {
+				t.Fatalf("sendQueue.pop() == %q for %q, want %q", qe.event.String(), tt.events, w)
+			}
+			q.done(qe, nil)
+		}
+
+		if qe, _ := q.pop(PriorityBulk); qe != nil {
+			t.Fatalf("sendQueue.pop() == %q on empty queue", qe.event.String())
+		}
+	}
+}
+
+func TestSendQueueSize(t *testing.T) {
+	q := newSendQueue(2)
+
+	reserve := func(priority Priority) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		return q.reserve(ctx, priority)
+	}
+
+	for _, raw := range []string{"PRIVMSG #a 1", "WHO #a"} {
+		if err := reserve(PriorityInteractive); err != nil {
+			t.Fatalf("sendQueue.reserve() == %v with room left", err)
+		}
+
+		e := ParseEvent(raw)
+		q.push(DefaultPriority(e), e, nil)
+	}
+
+	if err := reserve(PriorityInteractive); err != context.DeadlineExceeded {
+		t.Fatalf("sendQueue.reserve() == %v on full queue, want context.DeadlineExceeded", err)
+	}
+
+	// Critical events are never blocked.
+	if err := reserve(PriorityCritical); err != nil {
+		t.Fatalf("sendQueue.reserve() == %v for critical event", err)
+	}
+
+	// Sending an event makes room for another one, as does dropping them.
+	qe, _ := q.pop(PriorityBulk)
+	q.done(qe, nil)
+
+	if err := reserve(PriorityBulk); err != nil {
+		t.Fatalf("sendQueue.reserve() == %v after pop", err)
+	}
+	q.release(PriorityBulk)
+
+	q.clear(ErrNotConnected)
+	for i := 0; i < 2; i++ {
+		if err := reserve(PriorityInteractive); err != nil {
+			t.Fatalf("sendQueue.reserve() == %v after clear", err)
+		}
+	}
+}
+
+func TestSendQueueBatch(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.maxMsgLen = c.getMaxLen()
+	c.state.enabledCap["message-tags"] = nil
+	c.state.enabledCap["draft/multiline"] = map[string]string{"max-bytes": "4096"}
+
+	q := newSendQueue(0)
+
+	events, ok := c.splitMultiline(&Event{Command: PRIVMSG, Params: []string{"#a", "line 1\nline 2"}})
+	if !ok {
+		t.Fatal("message wasn't split into a multiline batch")
+	}
+	ref := events[0].Params[0][1:]
+
+	// A message to the same target right after the multiline message, and
+	// one to another target.
+	events = append(events,
+		&Event{Command: PRIVMSG, Params: []string{"#A", "after"}},
+		&Event{Command: PRIVMSG, Params: []string{"#b", "other"}},
+	)
+
+	for _, e := range events {
+		q.push(DefaultPriority(e), e, nil)
+	}
+
+	want := []string{
+		"BATCH +REF draft/multiline #a",
+		"PRIVMSG #b other",
+		"@batch=REF PRIVMSG #a :line 1",
+		"@batch=REF PRIVMSG #a :line 2",
+		"BATCH -REF",
+		"PRIVMSG #A after",
+	}
+
+	for _, w := range want {
+		qe, _ := q.pop(PriorityBulk)
+		if qe == nil {
+			t.Fatalf("sendQueue.pop() == nil, want %q", w)
+		}
+
+		if got := strings.Replace(string(qe.event.Bytes()), ref, "REF", -1); got != w {
+			t.Fatalf("sendQueue.pop() == %q, want %q", got, w)
+		}
+		q.done(qe, nil)
+	}
+
+	if len(q.batches) != 0 {
+		t.Fatalf("sendQueue still keeps track of batches: %v", q.batches)
+	}
+}
+
+func TestSendQueueCritical(t *testing.T) {
+	c, conn, server := genMockConn()
+	// Only a single event can be sent without being delayed.
+	c.Config.RateLimiter = &TokenBucket{Burst: 1, Refill: time.Hour}
+	defer server.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		b := bufio.NewReader(server)
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	go c.MockConnect(conn)
+	defer c.Close()
+
+	for line := range lines {
+		if strings.HasPrefix(line, "USER") {
+			break
+		}
+	}
+
+	expect := func(want string) {
+		t.Helper()
+
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Fatalf("server received %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	c.Cmd.Message("#a", "1")
+	expect("PRIVMSG #a 1")
+
+	// The second message is delayed, which shouldn't delay the PONG.
+	c.Cmd.Message("#a", "2")
+	c.Cmd.Pong("token")
+	expect("PONG token")
+
+	// Only the delayed message should be left.
+	deadline := time.Now().Add(5 * time.Second)
+	for c.SendQueueLen() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Client.SendQueueLen() == %d, want 1", c.SendQueueLen())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.RateLimiter = &TokenBucket{Burst: 2, Refill: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := &Event{Command: PRIVMSG, Params: []string{"#a", "test"}}
+	if err := c.SendContext(ctx, event.Copy()); err != ErrNotConnected {
+		t.Fatalf("Client.SendContext() == %v while disconnected, want ErrNotConnected", err)
+	}
+
+	go mockReadBuffer(server)
+	go c.MockConnect(conn)
+
+	for !c.IsConnected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.SendContext(ctx, event.Copy()); err != nil {
+		t.Fatalf("Client.SendContext() == %v, want nil", err)
+	}
+
+	// The next event is delayed, and has to be dropped once the connection
+	// is gone.
+	c.Send(event.Copy())
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.SendContext(ctx, event.Copy()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Client.SendContext() == nil after disconnect, want error")
+		}
+	case <-ctx.Done():
+		t.Fatal("Client.SendContext() did not return after disconnect")
+	}
+}
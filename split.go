@@ -90,6 +90,15 @@ func (c *Client) getMaxLen() int {
 	return maxIRClen - maxPrefixLen
 }
 
+// maxMessageLen returns the maximum length of an IRC message sent by the
+// client, as calculated by Client.getMaxLen() once connected.
+func (c *Client) maxMessageLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.maxMsgLen
+}
+
 // splitEvent splits a given event into multiple events to satisfy the
 // maximum message length requirements imposed upon the given client by
 // the associated IRC server.
@@ -100,10 +109,11 @@ func (c *Client) splitEvent(event *Event) []*Event {
 	// take into account by `event.Len()`.
 	event.Source = nil // XXX: Operate on a copy instead?
 
-	if event.Len() > c.maxMsgLen {
+	maxLen := c.maxMessageLen()
+	if event.Len() > maxLen {
 		fn, ok := splitFuncs[event.Command]
 		if ok {
-			return fn(event, c.maxMsgLen)
+			return fn(event, maxLen)
 		}
 	}
 
@@ -28,24 +28,58 @@ type state struct {
 	// last capability check. These will get sent once we have received the
 	// last capability list command from the server.
 	tmpCap map[string]map[string]string
+	// serverCaps are the capabilities advertised by the server (with CAP LS
+	// and CAP NEW), and their values.
+	serverCaps map[string]map[string]string
+	// capReqs is the amount of CAP REQ lines sent while negotiating
+	// capabilities, which haven't been replied to yet.
+	capReqs int
 	// serverOptions are the standard capabilities and configurations
 	// supported by the server at connection time. This also includes
 	// RPL_ISUPPORT entries.
 	serverOptions map[string]string
 	// motd is the servers message of the day.
 	motd string
+	// batches are the batches which have been started by the server, but
+	// not completed yet, keyed by their reference tag.
+	batches map[string]*Batch
+	// batchOrder holds the reference tags of the open batches, in the order
+	// they have been started.
+	batchOrder []string
+	// sasl is the SASL authentication in progress, if any.
+	sasl *saslState
+
+	// keys are the channel keys supplied with Commands.JoinKey(), keyed by
+	// the rfc1459 channel name. These survive reconnects.
+	keys map[string]string
+	// away is the away message last set with Commands.Away(), which
+	// survives reconnects.
+	away string
+	// rejoin are the channels (and their keys) we were in before the last
+	// reset, which should be rejoined once registered with the server.
+	rejoin map[string]string
 
 	// sts are strict transport security configurations, if specified by the
-	// server.
-	//
-	// TODO: ideally, this would be a configurable policy store that the user could
-	// optionally override (to store STS information on disk, memory, etc).
+	// server. See Config.STSStore for persisting these.
 	sts strictTransport
 }
 
 // reset resets the state back to it's original form.
 func (s *state) reset(initial bool) {
 	s.Lock()
+	if initial {
+		s.keys = make(map[string]string)
+		s.away = ""
+		s.rejoin = nil
+	} else if len(s.channels) > 0 {
+		// Only replace the list when we were actually in channels, so a
+		// failed connection attempt doesn't forget what to rejoin.
+		s.rejoin = make(map[string]string, len(s.channels))
+		for name, channel := range s.channels {
+			s.rejoin[channel.Name] = s.keys[name]
+		}
+	}
+
 	s.nick = ""
 	s.ident = ""
 	s.host = ""
@@ -54,7 +88,12 @@ func (s *state) reset(initial bool) {
 	s.serverOptions = make(map[string]string)
 	s.enabledCap = make(map[string]map[string]string)
 	s.tmpCap = make(map[string]map[string]string)
+	s.serverCaps = make(map[string]map[string]string)
+	s.capReqs = 0
 	s.motd = ""
+	s.batches = make(map[string]*Batch)
+	s.batchOrder = nil
+	s.sasl = nil
 
 	if initial {
 		s.sts.reset()
@@ -411,6 +450,7 @@ func (s *state) deleteChannel(name string) {
 	}
 
 	delete(s.channels, name)
+	delete(s.keys, name)
 }
 
 // lookupChannel returns a reference to a channel, nil returned if no results
@@ -0,0 +1,234 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STSPolicy is a strict transport security persistence policy, which a
+// server has provided for a hostname. While the policy hasn't expired, the
+// client must only connect to the hostname securely, on Port.
+//
+// See: https://ircv3.net/specs/extensions/sts#the-duration-key
+type STSPolicy struct {
+	// Port is the port on which the server accepts secure connections.
+	Port int `json:"port"`
+	// Expires is the time at which the policy expires.
+	Expires time.Time `json:"expires"`
+	// Preload is true if the server has consented to being included in
+	// STS preload lists.
+	Preload bool `json:"preload"`
+}
+
+// Expired returns true if the policy has expired.
+func (p STSPolicy) Expired() bool {
+	return !time.Now().Before(p.Expires)
+}
+
+// STSStore persists strict transport security policies, keyed by the
+// (lowercase) hostname the policy applies to. By default, policies are
+// only kept in memory for the lifetime of the client. See Config.STSStore,
+// and STSFileStore for an implementation which stores policies on disk.
+type STSStore interface {
+	// Get returns the policy for host. If no policy is stored for host, ok
+	// is false.
+	Get(host string) (policy STSPolicy, ok bool, err error)
+	// Set stores the policy for host, replacing an existing one.
+	Set(host string, policy STSPolicy) error
+	// Delete removes the policy for host, if any.
+	Delete(host string) error
+}
+
+// STSFileStore is an STSStore which keeps the policies in a JSON file, which
+// is created if it doesn't exist. It is safe for concurrent use by multiple
+// clients within the same process.
+type STSFileStore struct {
+	// Path is the path of the JSON file.
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewSTSFileStore returns a new STSFileStore using the file at path.
+func NewSTSFileStore(path string) *STSFileStore {
+	return &STSFileStore{Path: path}
+}
+
+// Get returns the policy for host.
+func (s *STSFileStore) Get(host string) (policy STSPolicy, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.load()
+	if err != nil {
+		return policy, false, err
+	}
+
+	policy, ok = policies[strings.ToLower(host)]
+	return policy, ok, nil
+}
+
+// Set stores the policy for host.
+func (s *STSFileStore) Set(host string, policy STSPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	policies[strings.ToLower(host)] = policy
+	return s.save(policies)
+}
+
+// Delete removes the policy for host.
+func (s *STSFileStore) Delete(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := policies[strings.ToLower(host)]; !ok {
+		return nil
+	}
+
+	delete(policies, strings.ToLower(host))
+	return s.save(policies)
+}
+
+// load reads all policies from the file. Must lock STSFileStore.mu first!
+func (s *STSFileStore) load() (map[string]STSPolicy, error) {
+	policies := make(map[string]STSPolicy)
+
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return policies, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return policies, nil
+	}
+
+	if err = json.Unmarshal(b, &policies); err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+// save writes all policies to the file, replacing it atomically so a crash
+// doesn't leave a corrupt file behind. Must lock STSFileStore.mu first!
+func (s *STSFileStore) save(policies map[string]STSPolicy) error {
+	b, err := json.MarshalIndent(policies, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), s.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// loadSTSPolicy applies the policy stored for the active endpoint (if any)
+// to the state, so the client connects securely from the start. Expired
+// policies are removed from the store. Must lock Client.mu first!
+func (c *Client) loadSTSPolicy() {
+	endpoint := c.activeEndpoint()
+	if c.Config.STSStore == nil || c.Config.DisableSTS || c.state.sts.enabled() || endpoint.WebSocket != nil {
+		return
+	}
+
+	host := endpoint.Server
+
+	policy, ok, err := c.Config.STSStore.Get(host)
+	if err != nil {
+		c.debug.Printf("unable to load strict transport policy for %s: %v", host, err)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	if policy.Expired() || policy.Port < 1 {
+		c.debug.Printf("removing expired strict transport policy for %s", host)
+		if err = c.Config.STSStore.Delete(host); err != nil {
+			c.debug.Printf("unable to remove strict transport policy for %s: %v", host, err)
+		}
+		return
+	}
+
+	c.debug.Printf("using stored strict transport policy for %s (port %d, expires %s)", host, policy.Port, policy.Expires)
+	c.state.sts.upgradePort = policy.Port
+	c.state.sts.persistenceDuration = int(time.Until(policy.Expires).Seconds())
+	c.state.sts.persistenceReceived = time.Now()
+	c.state.sts.preload = policy.Preload
+}
+
+// saveSTSPolicy stores the persistence policy the server has provided for
+// the active endpoint, which must be connected to securely. A duration of 0
+// removes the policy.
+func (c *Client) saveSTSPolicy(duration int, preload bool) {
+	if c.Config.STSStore == nil {
+		return
+	}
+
+	c.mu.RLock()
+	host := c.activeEndpoint().Server
+	_, rawPort, _ := net.SplitHostPort(c.server())
+	c.mu.RUnlock()
+
+	var err error
+	if duration <= 0 {
+		c.debug.Printf("removing strict transport policy for %s", host)
+		err = c.Config.STSStore.Delete(host)
+	} else {
+		port, _ := strconv.Atoi(rawPort)
+		err = c.Config.STSStore.Set(host, STSPolicy{
+			Port:    port,
+			Expires: time.Now().Add(time.Duration(duration) * time.Second),
+			Preload: preload,
+		})
+	}
+
+	if err != nil {
+		c.debug.Printf("unable to store strict transport policy for %s: %v", host, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSTSFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "girc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sts.json")
+	store := NewSTSFileStore(path)
+
+	if _, ok, err := store.Get("irc.example.com"); ok || err != nil {
+		t.Fatalf("STSFileStore.Get() on missing file == %t, %v, want false, nil", ok, err)
+	}
+
+	want := STSPolicy{Port: 6697, Expires: time.Now().Add(time.Hour).Round(time.Second), Preload: true}
+	if err = store.Set("IRC.example.com", want); err != nil {
+		t.Fatalf("STSFileStore.Set() == %s", err)
+	}
+
+	// Use a new store, to make sure the policy was persisted.
+	policy, ok, err := NewSTSFileStore(path).Get("irc.example.com")
+	if !ok || err != nil || policy.Port != want.Port || !policy.Expires.Equal(want.Expires) || !policy.Preload {
+		t.Fatalf("STSFileStore.Get() == %#v, %t, %v, want %#v", policy, ok, err, want)
+	}
+
+	if err = store.Delete("irc.example.com"); err != nil {
+		t.Fatalf("STSFileStore.Delete() == %s", err)
+	}
+
+	if _, ok, _ = store.Get("irc.example.com"); ok {
+		t.Fatal("STSFileStore.Get() returned deleted policy")
+	}
+}
+
+// mockSTSStore is an in-memory STSStore.
+type mockSTSStore map[string]STSPolicy
+
+func (s mockSTSStore) Get(host string) (STSPolicy, bool, error) {
+	policy, ok := s[host]
+	return policy, ok, nil
+}
+
+func (s mockSTSStore) Set(host string, policy STSPolicy) error {
+	s[host] = policy
+	return nil
+}
+
+func (s mockSTSStore) Delete(host string) error {
+	delete(s, host)
+	return nil
+}
+
+func TestSTSStorePolicy(t *testing.T) {
+	tests := []struct {
+		policy STSPolicy
+		want   string
+	}{
+		{STSPolicy{Port: 6697, Expires: time.Now().Add(time.Hour)}, "dummy.int:6697"},
+		{STSPolicy{Port: 6697, Expires: time.Now().Add(-time.Hour)}, "dummy.int:6667"},
+	}
+
+	for _, tt := range tests {
+		c, _, _ := genMockConn()
+		store := mockSTSStore{"dummy.int": tt.policy}
+		c.Config.STSStore = store
+
+		dialer := &mockDialer{conns: make(chan net.Conn, 1), addrs: make(chan string, 1)}
+		go c.DialerConnect(dialer)
+
+		// The TLS handshake of the upgraded connection never completes, so
+		// only check where the client dialed.
+		conn := <-dialer.conns
+		go mockReadBuffer(conn)
+
+		select {
+		case addr := <-dialer.addrs:
+			if addr != tt.want {
+				t.Fatalf("connected to %q with policy %#v, want %q", addr, tt.policy, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for dial")
+		}
+
+		if _, ok := store["dummy.int"]; ok == tt.policy.Expired() {
+			t.Fatalf("expired policy kept (or valid policy removed) from store: %#v", store)
+		}
+
+		c.Close()
+		conn.Close()
+	}
+}
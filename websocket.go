@@ -0,0 +1,394 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// IRCv3 WebSocket subprotocols, see https://ircv3.net/specs/extensions/websocket.
+const (
+	wsProtocolText   = "text.ircv3.net"
+	wsProtocolBinary = "binary.ircv3.net"
+)
+
+// wsGUID is used to calculate Sec-WebSocket-Accept, see RFC 6455 section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xa
+)
+
+// wsMaxMessage is the maximum size of a (reassembled) message we're willing
+// to receive. IRC lines (including tags) are much shorter than this.
+const wsMaxMessage = 64 * 1024
+
+// WebSocket configures connecting to the server using IRC over WebSocket
+// (ws://, or wss:// if SSL is enabled), rather than a plain TCP connection.
+// Each WebSocket message is a single IRC line. See Config.WebSocket.
+type WebSocket struct {
+	// Path is the path of the WebSocket endpoint on the server, including
+	// the query string if required. Defaults to "/".
+	Path string
+	// Origin is the optional Origin header sent during the handshake, which
+	// some servers require.
+	Origin string
+	// Header contains optional additional headers sent during the
+	// handshake.
+	Header http.Header
+	// Binary prefers the "binary.ircv3.net" subprotocol over the
+	// "text.ircv3.net" subprotocol. Text messages must be valid UTF-8, so
+	// invalid sequences are replaced when sending with the text
+	// subprotocol.
+	Binary bool
+}
+
+// ErrWebSocketHandshake is returned when the WebSocket handshake with the
+// server failed.
+type ErrWebSocketHandshake struct {
+	Reason string
+}
+
+func (e ErrWebSocketHandshake) Error() string { return "websocket handshake failed: " + e.Reason }
+
+// wsConn wraps a connection to a WebSocket server, translating the line
+// based IRC stream to WebSocket messages and back. This allows the rest of
+// the client to treat it like any other net.Conn.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	binary bool
+
+	// rbuf is the remainder of the last message read, which has not been
+	// consumed yet.
+	rbuf []byte
+
+	// wmu guards wbuf and writing frames to the connection.
+	wmu sync.Mutex
+	// wbuf is a partial line, which will be sent once the line is complete.
+	wbuf []byte
+}
+
+// newWebSocketConn performs the WebSocket handshake on conn with the server
+// at host, and returns the resulting connection.
+func newWebSocketConn(conn net.Conn, host string, secure bool, ws *WebSocket) (*wsConn, error) {
+	path := ws.Path
+	if path == "" {
+		path = "/"
+	}
+
+	protocols := []string{wsProtocolText, wsProtocolBinary}
+	if ws.Binary {
+		protocols[0], protocols[1] = protocols[1], protocols[0]
+	}
+
+	rawKey := make([]byte, 16)
+	if _, err := rand.Read(rawKey); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(rawKey)
+
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range ws.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	if ws.Origin != "" {
+		req.Header.Set("Origin", ws.Origin)
+	}
+
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &ErrWebSocketHandshake{Reason: "unexpected response: " + resp.Status}
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, &ErrWebSocketHandshake{Reason: "server did not upgrade to websocket"}
+	}
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, &ErrWebSocketHandshake{Reason: "invalid Sec-WebSocket-Accept"}
+	}
+
+	c := &wsConn{Conn: conn, br: br}
+
+	switch protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol {
+	case wsProtocolBinary:
+		c.binary = true
+	case wsProtocolText, "":
+		// Servers not supporting subprotocol negotiation use text.
+	default:
+		return nil, &ErrWebSocketHandshake{Reason: "unsupported subprotocol: " + protocol}
+	}
+
+	return c, nil
+}
+
+// Read reads the IRC stream, each WebSocket message being a line terminated
+// by "\r\n".
+func (c *wsConn) Read(b []byte) (n int, err error) {
+	for len(c.rbuf) == 0 {
+		var msg []byte
+		if msg, err = c.readMessage(); err != nil {
+			return 0, err
+		}
+
+		msg = bytes.TrimRight(msg, "\r\n")
+		if len(msg) == 0 {
+			continue
+		}
+
+		c.rbuf = append(msg, endline...)
+	}
+
+	n = copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// readMessage reads the next data message, reassembling fragmented
+// messages, and handling any control frames received in the meantime.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var started bool
+
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(c.br)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err = c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the close frame back, as required by RFC 6455 section
+			// 5.5.1, and let the client know that the connection is gone.
+			_ = c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, errors.New("websocket: unexpected new message within fragmented message")
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, errors.New("websocket: unexpected continuation frame")
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %#x", opcode)
+		}
+
+		if len(msg)+len(payload) > wsMaxMessage {
+			return nil, errors.New("websocket: message too large")
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// Write writes to the IRC stream. Each complete line is sent as a single
+// WebSocket message, without the line ending.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = append(c.wbuf, b...)
+
+	for {
+		i := bytes.IndexByte(c.wbuf, delim)
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimRight(c.wbuf[:i], "\r")
+		c.wbuf = c.wbuf[i+1:]
+
+		if len(line) == 0 {
+			continue
+		}
+
+		opcode := wsOpBinary
+		if !c.binary {
+			opcode = wsOpText
+			if !utf8.Valid(line) {
+				line = bytes.ToValidUTF8(line, []byte("�"))
+			}
+		}
+
+		if err := writeWebSocketFrame(c.Conn, opcode, line, true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// writeFrame writes a single (masked) frame to the server.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return writeWebSocketFrame(c.Conn, opcode, payload, true)
+}
+
+// Close sends a close frame to the server (on a best-effort basis), and
+// closes the underlying connection.
+func (c *wsConn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	// 1000 is a normal closure.
+	_ = c.writeFrame(wsOpClose, []byte{0x03, 0xe8})
+
+	return c.Conn.Close()
+}
+
+// readWebSocketFrame reads a single frame, unmasking the payload if
+// required.
+func readWebSocketFrame(r io.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > wsMaxMessage {
+		return false, 0, nil, errors.New("websocket: frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeWebSocketFrame writes payload as a single unfragmented frame. Frames
+// sent by clients must be masked, see RFC 6455 section 5.3.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	if !mask {
+		frame = append(frame, payload...)
+		_, err := w.Write(frame)
+		return err
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	frame = append(frame, key[:]...)
+
+	for i := range payload {
+		frame = append(frame, payload[i]^key[i%4])
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
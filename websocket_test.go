@@ -0,0 +1,170 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// mockWebSocketServer performs the server side of the WebSocket handshake
+// on conn, selecting the given subprotocol.
+func mockWebSocketServer(t *testing.T, conn net.Conn, protocol string) *bufio.Reader {
+	t.Helper()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatalf("failed to read handshake: %s", err)
+	}
+
+	if req.URL.Path != "/webirc" || req.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("unexpected handshake request: %s %#v", req.URL, req.Header)
+	}
+
+	accept := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n"
+
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		t.Fatalf("failed to write handshake: %s", err)
+	}
+
+	return br
+}
+
+func TestWebSocketConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan *wsConn, 1)
+	go func() {
+		ws, err := newWebSocketConn(client, "dummy.int:443", true, &WebSocket{Path: "/webirc"})
+		if err != nil {
+			t.Errorf("newWebSocketConn() == %s", err)
+		}
+		done <- ws
+	}()
+
+	br := mockWebSocketServer(t, server, wsProtocolText)
+	ws := <-done
+	if ws == nil || ws.binary {
+		t.Fatal("expected text subprotocol to be negotiated")
+	}
+
+	// As net.Pipe() is synchronous, read frames sent by the client in the
+	// background.
+	type frame struct {
+		opcode  byte
+		payload string
+	}
+	frames := make(chan frame, 5)
+	go func() {
+		for {
+			_, opcode, payload, err := readWebSocketFrame(br)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame{opcode, string(payload)}
+		}
+	}()
+
+	// A fragmented message, with a ping in between.
+	go func() {
+		server.Write([]byte{0x01, 0x06})
+		server.Write([]byte(":dummy"))
+		server.Write([]byte{0x89, 0x02, 'h', 'i'})
+		server.Write([]byte{0x80, 0x0e})
+		server.Write([]byte(".int PING :123"))
+	}()
+
+	line, err := bufio.NewReader(ws).ReadString('\n')
+	if err != nil || line != ":dummy.int PING :123\r\n" {
+		t.Fatalf("wsConn.Read() == %q (%v), want PING line", line, err)
+	}
+
+	if f := <-frames; f.opcode != wsOpPong || f.payload != "hi" {
+		t.Fatalf("expected pong frame, got %#x %q", f.opcode, f.payload)
+	}
+
+	if _, err = ws.Write([]byte("PONG :123\r\nNICK te")); err != nil {
+		t.Fatalf("wsConn.Write() == %s", err)
+	}
+
+	if f := <-frames; f.opcode != wsOpText || f.payload != "PONG :123" {
+		t.Fatalf("expected PONG line frame, got %#x %q", f.opcode, f.payload)
+	}
+}
+
+func TestWebSocketConnect(t *testing.T) {
+	c, _, _ := genMockConn()
+	c.Config.WebSocket = &WebSocket{Path: "/webirc", Binary: true}
+
+	dialer := &mockDialer{conns: make(chan net.Conn, 1)}
+	go c.DialerConnect(dialer)
+	defer c.Close()
+
+	conn := <-dialer.conns
+	defer conn.Close()
+	br := mockWebSocketServer(t, conn, wsProtocolBinary)
+
+	registered := make(chan struct{})
+	c.Handlers.Add(RPL_WELCOME, func(c *Client, e Event) { close(registered) })
+
+	go writeWebSocketFrame(conn, wsOpBinary, []byte(":dummy.int 001 test :Welcome"), false)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn.SetReadDeadline(deadline)
+		_, opcode, payload, err := readWebSocketFrame(br)
+		if err != nil {
+			t.Fatalf("failed waiting for NICK: %s", err)
+		}
+
+		if opcode != wsOpBinary {
+			t.Fatalf("expected binary frame, got %#x", opcode)
+		}
+
+		if string(payload) == "NICK test" {
+			break
+		}
+	}
+
+	select {
+	case <-registered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RPL_WELCOME sent over websocket was not received")
+	}
+}
+
+func TestWebSocketSTS(t *testing.T) {
+	c := New(Config{
+		Server:    "dummy.int",
+		Nick:      "test",
+		User:      "user",
+		WebSocket: &WebSocket{},
+		STSStore:  mockSTSStore{"dummy.int": {Port: 6697, Expires: time.Now().Add(time.Hour)}},
+	})
+
+	if _, ok := possibleCapList(c)["sts"]; ok {
+		t.Fatal("possibleCapList() contains sts for a WebSocket endpoint")
+	}
+
+	c.mu.Lock()
+	c.loadSTSPolicy()
+	c.mu.Unlock()
+
+	if c.state.sts.enabled() {
+		t.Fatal("stored strict transport policy applied to a WebSocket endpoint")
+	}
+}